@@ -0,0 +1,124 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"regexp"
+)
+
+// what a token may do, each role can do what the ones before it can
+const (
+	role_viewer   = "viewer"
+	role_operator = "operator"
+	role_admin    = "admin"
+)
+
+var role_ranks = map[string]int{role_viewer: 1, role_operator: 2, role_admin: 3}
+
+// tokens are random, a plain hash of them is enough to keep them secret
+const token_hash_prefix = "sha256:"
+
+var valid_token_hash = regexp.MustCompile("^sha256:[0-9a-f]{64}$")
+
+// TokenBody is an API token; only its hash is kept
+type TokenBody struct {
+	Name string
+	Hash string
+	// viewer, operator or admin
+	Role string
+}
+
+// TokensBody is the content of a tokens file
+type TokensBody struct {
+	Tokens []TokenBody
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return token_hash_prefix + hex.EncodeToString(sum[:])
+}
+
+// NewToken makes a random token and the hash to configure for it
+func NewToken() (token string, hash string, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token = "pci_" + hex.EncodeToString(secret)
+	return token, hashToken(token), nil
+}
+
+// the tokens of a tokens file, or everything wrong with it. Names are
+// unique among the ones already seen.
+func readTokensFile(file string, names map[string]bool) ([]TokenBody, []error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, []error{err}
+	}
+	var body TokensBody
+	v := &configValidator{file: file}
+	if v.decode(content, &body) {
+		v.validateTokens("Tokens", body.Tokens, names)
+	}
+	return body.Tokens, v.sortedErrors()
+}
+
+// the token a bearer token is, nil when there is none
+func authenticate(tokens []TokenBody, bearer string) *TokenBody {
+	hash := []byte(hashToken(bearer))
+	var found *TokenBody
+	// every hash is compared, in constant time
+	for i := range tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(tokens[i].Hash)) == 1 {
+			found = &tokens[i]
+		}
+	}
+	return found
+}
+
+func (t *TokenBody) allows(role string) bool {
+	return role_ranks[t.Role] >= role_ranks[role]
+}
+
+func (v *configValidator) validateTokens(path string, tokens []TokenBody, names map[string]bool) {
+	for i := range tokens {
+		token_path := indexPath(path, i)
+		v.checkName(joinPath(token_path, "Name"), "token", tokens[i].Name, names)
+		if !valid_token_hash.MatchString(tokens[i].Hash) {
+			v.add(joinPath(token_path, "Hash"), "invalid token hash, expected %s<64 hex digits>", token_hash_prefix)
+		}
+		if role_ranks[tokens[i].Role] == 0 {
+			v.add(joinPath(token_path, "Role"), "invalid role '%s', expected %s, %s or %s",
+				tokens[i].Role, role_viewer, role_operator, role_admin)
+		}
+	}
+}
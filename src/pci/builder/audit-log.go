@@ -0,0 +1,126 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditEntry is a line of the audit log: who asked for what, on which
+// build, and what they were answered
+type auditEntry struct {
+	Time   time.Time
+	Token  string `json:",omitempty"`
+	Role   string `json:",omitempty"`
+	Remote string
+	Method string
+	Path   string
+	Build  string `json:",omitempty"`
+	Status int
+}
+
+var audit_mutex sync.Mutex
+
+// auditWriter remembers the status a request was answered with
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	build  string
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// the build a request is about, looked up before it is handled
+func auditBuild(r *http.Request) string {
+	parts := strings.Split(r.URL.Path, "/")
+	switch {
+	case regexps["hook_re"].MatchString(r.URL.Path):
+		return parts[3]
+	case regexps["request_re"].MatchString(r.URL.Path):
+		id := requestId(r)
+		for _, request := range builder.Queue() {
+			if request.Id == id {
+				return request.Build
+			}
+		}
+	case len(parts) > 4 && parts[3] == "builds":
+		return parts[4]
+	}
+	return ""
+}
+
+// the audit log of a builder, next to the runs of its builds
+func (b *Builder) auditFile() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return filepath.Join(b.runs.directory, b.name, "audit.log")
+}
+
+// appends what a request did to the audit log
+func (b *Builder) audit(r *http.Request, w *auditWriter) {
+	entry := auditEntry{Time: time.Now(),
+		Remote: r.RemoteAddr,
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Build:  w.build,
+		Status: w.status}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		entry.Remote = host
+	}
+	if token := requestToken(r); token != nil {
+		entry.Token = token.Name
+		entry.Role = token.Role
+	}
+	content, _ := json.Marshal(entry)
+	file := b.auditFile()
+	audit_mutex.Lock()
+	defer audit_mutex.Unlock()
+	if err := os.MkdirAll(filepath.Dir(file), 0770); err != nil {
+		log.Printf("error: can't audit %s %s: %v", r.Method, r.URL.Path, err)
+		return
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		log.Printf("error: can't audit %s %s: %v", r.Method, r.URL.Path, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(content, '\n')); err != nil {
+		log.Printf("error: can't audit %s %s: %v", r.Method, r.URL.Path, err)
+	}
+}
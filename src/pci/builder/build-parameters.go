@@ -0,0 +1,184 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ParameterBody declares a value given to a build when it is triggered
+type ParameterBody struct {
+	Name string
+	// "string" (the default), "int" or "bool"
+	Type          string   `json:",omitempty"`
+	Default       string   `json:",omitempty"`
+	AllowedValues []string `json:",omitempty"`
+	Description   string   `json:",omitempty"`
+}
+
+const (
+	parameter_string = "string"
+	parameter_int    = "int"
+	parameter_bool   = "bool"
+)
+
+// parameters are environment variables too
+var valid_parameter = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+var parameter_reference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+func (p *ParameterBody) check(value string) error {
+	switch p.Type {
+	case parameter_int:
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("parameter %s is not an integer: '%s'", p.Name, value)
+		}
+	case parameter_bool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("parameter %s is not a boolean: '%s'", p.Name, value)
+		}
+	}
+	if len(p.AllowedValues) == 0 {
+		return nil
+	}
+	for _, allowed := range p.AllowedValues {
+		if value == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("parameter %s must be one of %s, not '%s'",
+		p.Name, strings.Join(p.AllowedValues, ", "), value)
+}
+
+// the default, else the first allowed value, else the zero value of its type
+func (p *ParameterBody) defaultValue() string {
+	switch {
+	case p.Default != "":
+		return p.Default
+	case len(p.AllowedValues) > 0:
+		return p.AllowedValues[0]
+	case p.Type == parameter_int:
+		return "0"
+	case p.Type == parameter_bool:
+		return "false"
+	}
+	return ""
+}
+
+// the parameters of a run nobody gave values for
+func (build *Build) parameterDefaults() map[string]string {
+	if len(build.parameters) == 0 {
+		return nil
+	}
+	values := make(map[string]string)
+	for i := range build.parameters {
+		values[build.parameters[i].Name] = build.parameters[i].defaultValue()
+	}
+	return values
+}
+
+// checks the values given when triggering a build and completes them with
+// the defaults
+func (build *Build) resolveParameters(given map[string]string) (map[string]string, error) {
+	values := build.parameterDefaults()
+	for name, value := range given {
+		var parameter *ParameterBody
+		for i := range build.parameters {
+			if build.parameters[i].Name == name {
+				parameter = &build.parameters[i]
+			}
+		}
+		if parameter == nil {
+			return nil, fmt.Errorf("build %s has no parameter %s", build.name, name)
+		}
+		if err := parameter.check(value); err != nil {
+			return nil, err
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// words the shell reads as they are
+var shell_safe = regexp.MustCompile("^[A-Za-z0-9_@%+=:,./-]+$")
+
+// quotes a word for /bin/sh, so that it is a single argument whatever it holds
+func shellQuote(s string) string {
+	if shell_safe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", "'\\''", -1) + "'"
+}
+
+// the values of the parameters as shell words, for commands run through the
+// shell: whoever triggers a build may give any value, but must not be able
+// to change what it runs
+func quoteParameters(values map[string]string) map[string]string {
+	quoted := make(map[string]string, len(values))
+	for name, value := range values {
+		quoted[name] = shellQuote(value)
+	}
+	return quoted
+}
+
+// parameters are environment variables, secret-looking ones are hidden
+// from the API the same way
+func redactParameters(values map[string]string) map[string]string {
+	if len(values) == 0 {
+		return values
+	}
+	return redactEnvironment(values)
+}
+
+// values substituted into a directory can't leave it, so that whoever
+// triggers a build can't make a command run elsewhere
+func checkDirectoryParameters(dir string, values map[string]string) error {
+	for _, match := range parameter_reference.FindAllStringSubmatch(dir, -1) {
+		value, ok := values[match[1]]
+		if ok && (strings.Contains(value, "/") || strings.Contains(value, "..")) {
+			return fmt.Errorf("parameter %s can't be '%s' in a directory", match[1], value)
+		}
+	}
+	return nil
+}
+
+// replaces ${name} with the value of the parameter name. References to
+// anything else, such as shell variables, are left alone.
+func substituteParameters(s string, values map[string]string) string {
+	if len(values) == 0 {
+		return s
+	}
+	return parameter_reference.ReplaceAllStringFunc(s, func(reference string) string {
+		if value, ok := values[reference[2:len(reference)-1]]; ok {
+			return value
+		}
+		return reference
+	})
+}
@@ -0,0 +1,227 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// how requests for a build that is already queued are merged: never, when
+// they ask for the same run, or always, the newest one updating the queued
+// request
+const (
+	coalesce_none      = "none"
+	coalesce_identical = "identical"
+	coalesce_build     = "build"
+)
+
+// buildRequest asks for one run of a build
+type buildRequest struct {
+	Id         int
+	Build      string
+	Reason     string
+	Requester  string            `json:",omitempty"`
+	Parameters map[string]string `json:",omitempty"`
+	Ref        string            `json:",omitempty"`
+	Commit     string            `json:",omitempty"`
+	Priority   int
+	Queued     time.Time
+}
+
+func newBuildRequest(build *Build, reason string, requester string) *buildRequest {
+	return &buildRequest{Build: build.name,
+		Reason:     reason,
+		Requester:  requester,
+		Parameters: build.parameterDefaults(),
+		Priority:   build.priority}
+}
+
+func (r *buildRequest) sameRun(other *buildRequest) bool {
+	if len(r.Parameters) == 0 && len(other.Parameters) == 0 {
+		return r.Ref == other.Ref && r.Commit == other.Commit
+	}
+	return r.Ref == other.Ref && r.Commit == other.Commit &&
+		reflect.DeepEqual(r.Parameters, other.Parameters)
+}
+
+// the build's own coalescing wins over the builder's
+func (b *Builder) coalesceMode(build *Build) string {
+	switch {
+	case build.coalesce != "":
+		return build.coalesce
+	case b.coalesce != "":
+		return b.coalesce
+	}
+	return coalesce_identical
+}
+
+// Enqueue adds a request for a build, unless it is coalesced with one
+// already queued. Returns the queued request and whether it was coalesced.
+func (b *Builder) Enqueue(build *Build, request *buildRequest) (*buildRequest, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.enqueue(build, request)
+}
+
+// must be called with the mutex held
+func (b *Builder) enqueue(build *Build, request *buildRequest) (*buildRequest, bool) {
+	mode := b.coalesceMode(build)
+	for _, queued := range b.queue {
+		if queued.Build != build.name || mode == coalesce_none {
+			continue
+		}
+		if mode == coalesce_build {
+			queued.Reason = request.Reason
+			queued.Requester = request.Requester
+			queued.Parameters = request.Parameters
+			queued.Ref = request.Ref
+			queued.Commit = request.Commit
+			log.Printf("Request %d of %s updated (%s)", queued.Id, build.name, request.Reason)
+			return queued, true
+		}
+		if queued.sameRun(request) {
+			log.Printf("Request of %s (%s) coalesced with request %d", build.name, request.Reason, queued.Id)
+			return queued, true
+		}
+	}
+	b.next_request++
+	request.Id = b.next_request
+	request.Build = build.name
+	request.Queued = time.Now()
+	b.queue = append(b.queue, request)
+	log.Printf("Request %d queues %s (%s)", request.Id, build.name, request.Reason)
+	if build.state != State_queued && build.state != State_running {
+		logTransition(build.setState(State_queued))
+	}
+	return request, false
+}
+
+// Dequeue drops a queued request. A build left without requests is
+// cancelled.
+func (b *Builder) Dequeue(id int) (*buildRequest, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, request := range b.queue {
+		if request.Id != id {
+			continue
+		}
+		b.queue = append(b.queue[:i], b.queue[i+1:]...)
+		log.Printf("Request %d of %s dropped", id, request.Build)
+		build := b.getBuild(request.Build)
+		if build != nil && build.state == State_queued && b.queuedRequests(build.name) == 0 {
+			logTransition(build.setState(State_cancelled))
+		}
+		return request, nil
+	}
+	return nil, fmt.Errorf("request %d is not queued", id)
+}
+
+// takes a request out of the queue, must be called with the mutex held
+func (b *Builder) removeRequest(id int) {
+	for i, request := range b.queue {
+		if request.Id == id {
+			b.queue = append(b.queue[:i], b.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// drops every request of a build, must be called with the mutex held
+func (b *Builder) dropRequests(name string) {
+	var queue []*buildRequest
+	for _, request := range b.queue {
+		if request.Build == name {
+			log.Printf("Request %d of %s dropped", request.Id, name)
+			continue
+		}
+		queue = append(queue, request)
+	}
+	b.queue = queue
+}
+
+func (b *Builder) queuedRequests(name string) (n int) {
+	for _, request := range b.queue {
+		if request.Build == name {
+			n++
+		}
+	}
+	return n
+}
+
+// the requests in the order they run, lowest priority value first and
+// oldest first among equals
+func (b *Builder) sortedQueue() []*buildRequest {
+	queue := append([]*buildRequest{}, b.queue...)
+	sort.SliceStable(queue, func(i, j int) bool {
+		return queue[i].Priority < queue[j].Priority
+	})
+	return queue
+}
+
+// a copy of the request to show through the API
+func (r buildRequest) redacted() *buildRequest {
+	r.Parameters = redactParameters(r.Parameters)
+	return &r
+}
+
+// Queue returns a copy of the queued requests in the order they run
+func (b *Builder) Queue() []buildRequest {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	queue := []buildRequest{}
+	for _, request := range b.sortedQueue() {
+		queue = append(queue, *request)
+	}
+	return queue
+}
+
+// builds set to queued by the configuration get a request of their own,
+// must be called with the mutex held
+func (b *Builder) adoptQueuedBuilds() {
+	for _, build := range b.builds {
+		if build.state == State_queued && b.queuedRequests(build.name) == 0 {
+			b.enqueue(build, newBuildRequest(build, "configuration", ""))
+		}
+	}
+}
+
+// a build with requests left is queued again when its run finishes, must
+// be called with the mutex held
+func (b *Builder) requeue(name string) {
+	build := b.getBuild(name)
+	if build == nil {
+		b.dropRequests(name)
+		return
+	}
+	if build.state != State_queued && build.state != State_running && b.queuedRequests(name) > 0 {
+		logTransition(build.setState(State_queued))
+	}
+}
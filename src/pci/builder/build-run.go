@@ -0,0 +1,149 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"time"
+)
+
+type CommandRun struct {
+	Name     string
+	State    string
+	ExitCode int
+	Started  time.Time
+	Finished time.Time
+	Duration string
+}
+
+type StageRun struct {
+	Name     string
+	State    string
+	Started  time.Time
+	Finished time.Time
+	Duration string
+	Commands []CommandRun
+}
+
+// BuildRun is one execution of a build
+type BuildRun struct {
+	Id       int
+	Build    string
+	State    string
+	Started  time.Time
+	Finished time.Time
+	Duration string
+	// the request that started the run
+	Request    int               `json:",omitempty"`
+	Reason     string            `json:",omitempty"`
+	Requester  string            `json:",omitempty"`
+	Parameters map[string]string `json:",omitempty"`
+	// the ref pushed when a webhook queued the build
+	Ref string `json:",omitempty"`
+	// the commit of the build's Source that was checked out, or the one
+	// pushed
+	Commit string `json:",omitempty"`
+	// why the build couldn't run its stages
+	Error  string `json:",omitempty"`
+	Stages []StageRun
+}
+
+// a copy of the run to show through the API, run files keep the values
+func (r BuildRun) redacted() *BuildRun {
+	r.Parameters = redactParameters(r.Parameters)
+	return &r
+}
+
+func runDuration(started time.Time, finished time.Time) string {
+	return finished.Sub(started).String()
+}
+
+func newBuildRun(id int, build *Build) *BuildRun {
+	return &BuildRun{Id: id,
+		Build:   build.name,
+		State:   state2str(State_running),
+		Started: time.Now()}
+}
+
+// commands that never ran take the state of their stage when it was
+// cancelled and are recorded as skipped otherwise
+func newCommandRun(c *shellCommand, stage_state int) CommandRun {
+	result := c.Result()
+	if result.state == State_queued {
+		if stage_state != State_cancelled {
+			stage_state = State_skipped
+		}
+		return CommandRun{Name: c.name, State: state2str(stage_state), ExitCode: -1}
+	}
+	run := CommandRun{Name: c.name, State: state2str(result.state)}
+	run.ExitCode = result.exit_code
+	run.Started = result.started
+	run.Finished = result.finished
+	run.Duration = runDuration(result.started, result.finished)
+	return run
+}
+
+func (r *BuildRun) AddStage(s *Stage) {
+	stage_run := StageRun{Name: s.name,
+		State:    state2str(s.state),
+		Started:  s.started,
+		Finished: s.finished,
+		Duration: runDuration(s.started, s.finished)}
+	for _, c := range s.commands {
+		stage_run.Commands = append(stage_run.Commands, newCommandRun(c, s.state))
+	}
+	r.Stages = append(r.Stages, stage_run)
+}
+
+func (r *BuildRun) hasStage(name string) bool {
+	for _, s := range r.Stages {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// stages that never ran are recorded as skipped, must be called once the
+// build has reached its final state
+func (r *BuildRun) Finish(build *Build) {
+	for _, s := range build.stages {
+		if !r.hasStage(s.name) {
+			state := s.state
+			if state != State_cancelled {
+				state = State_skipped
+			}
+			stage_run := StageRun{Name: s.name, State: state2str(state)}
+			for _, c := range s.commands {
+				stage_run.Commands = append(stage_run.Commands, newCommandRun(c, state))
+			}
+			r.Stages = append(r.Stages, stage_run)
+		}
+	}
+	r.State = state2str(build.state)
+	r.Finished = time.Now()
+	r.Duration = runDuration(r.Started, r.Finished)
+}
@@ -26,56 +26,285 @@
 
 package builder
 
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// per stage and per command logs, relative to the logs of the build
+const logs_directory = ".pci"
+
 type Build struct {
 	name      string
 	directory string
 	priority  int
 	state     int
+	timeout   time.Duration
+	env       map[string]string
 	stages    []*Stage
-	status    bool
+	cancelled bool
+	run_id    string
+	run       *BuildRun
+	log       *logStream
+	// holds stdio.txt and the stage and command logs, the build directory
+	// unless a checkout owns it
+	log_dir string
+	// the configuration it was loaded from, and what a reload left for
+	// when its run finishes
+	config  BuildBody
+	pending *Build
+	removed bool
+	// stages are read from this file, relative to directory, on every run
+	pipeline_file string
+	// the git repository checked out on every run, the last commit of it
+	// seen or checked out, and the one checked out for the current run
+	source         *SourceBody
+	source_known   bool
+	source_commit  string
+	source_next    time.Time
+	source_polling bool
+	commit         string
+	// lets pushes queue the build
+	webhook *WebhookBody
+	// the request being run, with its ref
+	request *buildRequest
+	ref     string
+	// how requests for the build are merged, the builder's way when unset
+	coalesce string
+	// values its requests give to its commands
+	parameters []ParameterBody
+	// queues the build when due, next at schedule_next
+	schedule      *cronSchedule
+	schedule_next time.Time
 }
 
 func NewBuild(name string,
 	directory string,
 	priority int,
-	state int) *Build {
+	state int,
+	timeout time.Duration,
+	env map[string]string) *Build {
 	return &Build{name: name,
 		directory: directory,
 		priority:  priority,
 		state:     state,
-		status:    true}
+		timeout:   timeout,
+		env:       env,
+		log_dir:   directory,
+		log:       newLogStream(filepath.Join(directory, "stdio.txt"))}
+}
+
+// moves the logs of a build that isn't running, along with those of its
+// stages
+func (b *Build) setLogDirectory(dir string) {
+	b.log_dir = dir
+	b.log = newLogStream(filepath.Join(dir, "stdio.txt"))
+	for _, s := range b.stages {
+		s.attachLogs(b)
+	}
 }
 
 func (b *Build) AddStage(s *Stage) {
 	b.stages = append(b.stages, s)
+	s.attachLogs(b)
+}
+
+// a build with a Source gets its directory from its checkout
+func (b *Build) openLog() error {
+	if ok, _ := exists(b.directory); !ok && b.source == nil {
+		return fmt.Errorf("%s doesn't exist", b.directory)
+	}
+	return b.log.Open(false)
 }
 
 func (b *Build) GetStages() *stageIterator {
 	return NewStageIterator(b.stages)
 }
 
-func (b *Build) PickStageByPriority() (winner *Stage) {
-	var stage *Stage
-	var i int
-	winner = nil
-	for i, stage = range b.stages {
-		if stage.state == State_ready {
-			winner = stage
-			i++
-			break
+// stages sorted by priority, lowest value first, keeping their order on ties
+func (b *Build) stagesByPriority() []*Stage {
+	stages := append([]*Stage(nil), b.stages...)
+	sort.SliceStable(stages, func(i, j int) bool {
+		return stages[i].priority < stages[j].priority
+	})
+	return stages
+}
+
+func (b *Build) getStage(name string) *Stage {
+	for _, s := range b.stages {
+		if s.name == name {
+			return s
 		}
 	}
-	if winner == nil {
+	return nil
+}
+
+func (b *Build) hasDependencies() bool {
+	for _, s := range b.stages {
+		if len(s.depends_on) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// without any DependsOn in the build every stage depends on the previous one
+// by priority, the order stages always ran in
+func (b *Build) dependencies(stage *Stage) (deps []*Stage) {
+	if !b.hasDependencies() {
+		var previous *Stage
+		for _, s := range b.stagesByPriority() {
+			if s == stage {
+				break
+			}
+			previous = s
+		}
+		if previous != nil {
+			deps = append(deps, previous)
+		}
+		return deps
+	}
+	for _, name := range stage.depends_on {
+		if dep := b.getStage(name); dep != nil {
+			deps = append(deps, dep)
+		}
+	}
+	return deps
+}
+
+// rejects unknown stages and cycles in DependsOn
+func (b *Build) CheckDependencies() error {
+	for _, s := range b.stages {
+		for _, name := range s.depends_on {
+			if b.getStage(name) == nil {
+				return fmt.Errorf("stage %s depends on unknown stage %s", s.name, name)
+			}
+		}
+	}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make(map[*Stage]int)
+	var visit func(s *Stage, path []string) error
+	visit = func(s *Stage, path []string) error {
+		path = append(path, s.name)
+		switch marks[s] {
+		case visiting:
+			return fmt.Errorf("stages depend on each other (%s)", strings.Join(path, " -> "))
+		case visited:
+			return nil
+		}
+		marks[s] = visiting
+		for _, dep := range b.dependencies(s) {
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+		marks[s] = visited
 		return nil
 	}
-	for _, stage = range b.stages[i:] {
-		if stage.state == State_ready {
-			if stage.priority < winner.priority {
-				winner = stage
+	for _, s := range b.stages {
+		if err := visit(s, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// must be called with the builder mutex held
+func (b *Build) setState(state int) error {
+	if err := transition(&b.state, state); err != nil {
+		return fmt.Errorf("build %s: %v", b.name, err)
+	}
+	return nil
+}
+
+// queues every stage again for a new run
+func (b *Build) resetStages() {
+	for _, s := range b.stages {
+		if s.state != State_queued {
+			logTransition(s.setState(State_queued))
+		}
+	}
+}
+
+// outcome of a run: cancelled if asked to, failed if any stage failed or was
+// cancelled, timed out if any stage ran out of time
+func (b *Build) result() int {
+	if b.cancelled {
+		return State_cancelled
+	}
+	result := State_succeeded
+	for _, s := range b.stages {
+		switch s.state {
+		case State_failed, State_cancelled:
+			return State_failed
+		case State_timed_out:
+			result = State_timed_out
+		}
+	}
+	return result
+}
+
+// Cancel drops a queued build, or stops every stage of a running one. It
+// must be called with the builder mutex held.
+func (b *Build) Cancel() bool {
+	switch b.state {
+	case State_queued:
+		logTransition(b.setState(State_cancelled))
+		return true
+	case State_running:
+		b.cancelled = true
+		for _, s := range b.stages {
+			s.Cancel()
+		}
+		return true
+	}
+	return false
+}
+
+// PickRunnableStages returns the queued stages whose dependencies succeeded
+// and skips the ones depending on a stage that didn't
+func (b *Build) PickRunnableStages() (runnable []*Stage, skipped []*Stage) {
+	stages := b.stagesByPriority()
+	for changed := true; changed; {
+		changed = false
+		for _, s := range stages {
+			if s.state != State_queued {
+				continue
+			}
+			for _, dep := range b.dependencies(s) {
+				if isFinished(dep.state) && dep.state != State_succeeded {
+					logTransition(s.setState(State_skipped))
+					skipped = append(skipped, s)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	for _, s := range stages {
+		if s.state != State_queued {
+			continue
+		}
+		blocked := false
+		for _, dep := range b.dependencies(s) {
+			if !isFinished(dep.state) {
+				blocked = true
 				break
 			}
 		}
+		if !blocked {
+			logTransition(s.setState(State_running))
+			s.cancel = make(chan struct{})
+			s.cancelled = false
+			runnable = append(runnable, s)
+		}
 	}
-	winner.state = State_building
-	return winner
+	return runnable, skipped
 }
@@ -27,10 +27,16 @@
 package builder
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode"
 )
 
 type jsonobject struct {
@@ -38,8 +44,19 @@ type jsonobject struct {
 }
 
 type BuilderBody struct {
-	Name   string
-	Builds []BuildBody
+	Name              string
+	MaxParallelBuilds int               `json:",omitempty"`
+	DataDirectory     string            `json:",omitempty"`
+	Env               map[string]string `json:",omitempty"`
+	LogTail           int               `json:",omitempty"`
+	LogStreamTags     bool              `json:",omitempty"`
+	// "none", "identical" (the default) or "build"
+	Coalesce string `json:",omitempty"`
+	// API tokens, and a file with more of them. Without any the API is open
+	Tokens     []TokenBody `json:",omitempty"`
+	TokensFile string      `json:",omitempty"`
+	Listen     *ListenBody `json:",omitempty"`
+	Builds     []BuildBody
 }
 
 type BuildBody struct {
@@ -47,115 +64,465 @@ type BuildBody struct {
 	Directory string
 	Priority  int
 	State     string
-	Stages    []StageBody
+	Timeout   string            `json:",omitempty"`
+	Env       map[string]string `json:",omitempty"`
+	Source    *SourceBody       `json:",omitempty"`
+	Webhook   *WebhookBody      `json:",omitempty"`
+	// 5-field cron expression queueing the build, read in TimeZone (the
+	// local one by default) and delayed by up to Jitter
+	Schedule string `json:",omitempty"`
+	TimeZone string `json:",omitempty"`
+	Jitter   string `json:",omitempty"`
+	Coalesce string `json:",omitempty"`
+	// values given when the build is triggered
+	Parameters []ParameterBody `json:",omitempty"`
+	// stages read from this file in Directory when the build runs
+	PipelineFile string      `json:",omitempty"`
+	Stages       []StageBody `json:",omitempty"`
+}
+
+// PipelineBody is the content of a build's pipeline file
+type PipelineBody struct {
+	Stages []StageBody
 }
 
 type StageBody struct {
-	Name     string
-	Priority int
-	State    string
-	Commands []CommandBody
+	Name      string
+	Priority  int
+	State     string
+	Timeout   string            `json:",omitempty"`
+	Env       map[string]string `json:",omitempty"`
+	DependsOn []string          `json:",omitempty"`
+	Commands  []CommandBody
 }
 
 type CommandBody struct {
 	Name      string
 	Command   string
-	Args      string
+	Args      commandArgs
+	Shell     bool `json:",omitempty"`
 	Directory string
+	Timeout   string            `json:",omitempty"`
+	Env       map[string]string `json:",omitempty"`
+}
+
+// Args is a JSON array; a plain string is still accepted and split the way
+// a shell would split it
+type commandArgs []string
+
+func (a *commandArgs) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*a = splitArgs(str)
+		return nil
+	}
+	var args []string
+	if err := json.Unmarshal(data, &args); err != nil {
+		return fmt.Errorf("Args must be a string or an array of strings")
+	}
+	*a = args
+	return nil
+}
+
+func (a commandArgs) MarshalJSON() ([]byte, error) {
+	if a == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]string(a))
+}
+
+func splitArgs(str string) (args []string) {
+	var arg []rune
+	var quote rune
+	in_arg := false
+	escaped := false
+	for _, r := range str {
+		switch {
+		case escaped:
+			arg = append(arg, r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			in_arg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg = append(arg, r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			in_arg = true
+		case unicode.IsSpace(r):
+			if in_arg {
+				args = append(args, string(arg))
+				arg = arg[:0]
+				in_arg = false
+			}
+		default:
+			arg = append(arg, r)
+			in_arg = true
+		}
+	}
+	if in_arg {
+		args = append(args, string(arg))
+	}
+	return args
 }
 
 var file_json string
 
-func loadJSON(file string) jsonobject {
+// save over file_json, keeping save_backups copies of what it replaces
+var save_in_place bool = false
+var save_backups int = 3
+
+// serializes writers of the configuration
+var save_mutex sync.Mutex
+
+// the content of file_json as last loaded or saved, so the watcher can tell
+// our own writes from edits
+var config_content []byte
+var config_content_mutex sync.Mutex
+
+func setConfigContent(content []byte) {
+	config_content_mutex.Lock()
+	defer config_content_mutex.Unlock()
+	config_content = content
+}
+
+func isConfigContent(content []byte) bool {
+	config_content_mutex.Lock()
+	defer config_content_mutex.Unlock()
+	return bytes.Equal(content, config_content)
+}
+
+// reads and validates a configuration, logging what is wrong with it
+func loadJSON(file string) (jsonobject, bool) {
 	log.Printf("Loading configuration '%s'", file)
 	content, err := ioutil.ReadFile(file)
 	if err != nil {
 		log.Printf("File error: %v\n", err)
-		os.Exit(1)
+		return jsonobject{}, false
+	}
+	object, errors := decodeConfig(file, content)
+	if len(errors) > 0 {
+		logErrors(errors)
+		return object, false
+	}
+	setConfigContent(content)
+	return object, true
+}
+
+func logErrors(errors []error) {
+	for _, err := range errors {
+		log.Printf("error: %v", err)
 	}
-	var object jsonobject
-	json.Unmarshal(content, &object)
-	return object
 }
 
-func saveJSON(object jsonobject, file string) {
+// checks a configuration file without loading it
+func ValidateJSON(file string) bool {
+	// files named in the configuration are relative to it
+	file_json = file
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Printf("File error: %v\n", err)
+		return false
+	}
+	if _, errors := decodeConfig(file, content); len(errors) > 0 {
+		logErrors(errors)
+		return false
+	}
+	log.Printf("Configuration '%s' is valid", file)
+	return true
+}
+
+// writes the configuration next to the loaded file, or over it when saving
+// in place. Must be called with save_mutex held.
+func saveJSON(object jsonobject) {
+	file := file_json + ".new"
+	if save_in_place {
+		file = file_json
+	}
 	log.Printf("Saving configuration '%s'", file)
-	content, err := json.MarshalIndent(object, "", "   ")
+	perm := os.FileMode(0644)
+	original, err := ioutil.ReadFile(file_json)
+	if err == nil {
+		if info, err := os.Stat(file_json); err == nil {
+			perm = info.Mode().Perm()
+		}
+	} else {
+		original = nil
+	}
+	content, err := formatConfig(object, original, configFormat(file_json))
 	if err != nil {
 		log.Println("error:", err)
 		return
 	}
-	err = ioutil.WriteFile(file, content, 0666)
-	if err != nil {
+	if save_in_place && original != nil {
+		if bytes.Equal(content, original) {
+			setConfigContent(content)
+			return
+		}
+		if err := rotateBackups(file, original, perm, save_backups); err != nil {
+			log.Printf("error: backup of '%s' failed: %v", file, err)
+			return
+		}
+	}
+	if err := writeFileAtomic(file, content, perm); err != nil {
 		log.Println("error:", err)
 		return
 	}
+	// only what is on disk is ours, anything else is reloaded
+	if save_in_place {
+		setConfigContent(content)
+	}
+}
+
+// timeouts are checked with the configuration, so loading ignores errors
+func str2duration(str string) (time.Duration, error) {
+	if str == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(str)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("negative duration %s", str)
+	}
+	return d, err
+}
+
+func duration2str(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// run history goes next to the configuration unless told otherwise
+func dataDirectory(configured string) string {
+	switch {
+	case data_dir_override != "":
+		return data_dir_override
+	case configured != "":
+		return configured
+	}
+	return filepath.Join(filepath.Dir(file_json), "pci-data")
+}
+
+// files named in the configuration are relative to it
+func configPath(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(filepath.Dir(file_json), file)
 }
 
 func NewBuilderFromCurrentJSON() *Builder {
 	return NewBuilderFromJSON(file_json)
 }
 
+// migrates legacy state names and queues again whatever was running when
+// the previous process went away
+func loadState(name string, str string) int {
+	state := str2state(str)
+	if isLegacyState(str) {
+		log.Printf("%s: migrating state %s to %s", name, str, state2str(state))
+	}
+	if state == State_running {
+		log.Printf("%s: was running, queued again", name)
+		state = State_queued
+	}
+	return state
+}
+
 func NewBuilderFromJSON(file string) *Builder {
 	file_json = file
-	object := loadJSON(file_json)
-	// TODO: check jsonobject is right!
-	builder := NewBuilder(object.Builder.Name)
+	builder, ok := loadBuilder(file_json)
+	if !ok {
+		os.Exit(1)
+	}
+	builder.SetIdle(false)
+	return builder
+}
+
+func loadBuilder(file string) (*Builder, bool) {
+	object, ok := loadJSON(file)
+	if !ok {
+		return nil, false
+	}
+	return newBuilderFromObject(object), true
+}
+
+// builds a builder from a configuration that passed the checks
+func newBuilderFromObject(object jsonobject) *Builder {
+	builder := NewBuilder(object.Builder.Name,
+		object.Builder.Env,
+		object.Builder.MaxParallelBuilds,
+		object.Builder.DataDirectory)
+	builder.log_tail = object.Builder.LogTail
+	builder.log_stream_tags = object.Builder.LogStreamTags
+	builder.coalesce = object.Builder.Coalesce
+	builder.tokens = object.Builder.Tokens
+	builder.tokens_file = object.Builder.TokensFile
+	builder.listen = object.Builder.Listen
+	builder.api_tokens = append([]TokenBody{}, builder.tokens...)
+	if builder.tokens_file != "" {
+		file_tokens, _ := readTokensFile(configPath(builder.tokens_file), map[string]bool{})
+		builder.api_tokens = append(builder.api_tokens, file_tokens...)
+	}
 	for build_i, build_v := range object.Builder.Builds {
-		build := NewBuild(build_v.Name, build_v.Directory, build_v.Priority, str2state(build_v.State))
-		for stage_i, stage_v := range object.Builder.Builds[build_i].Stages {
-			commands := NewShellCommands()
-			for _, command_v := range object.Builder.Builds[build_i].Stages[stage_i].Commands {
-				command := NewShellCommand(command_v.Name,
-					command_v.Command,
-					command_v.Args,
-					command_v.Directory,
-					build_v.Directory)
-				commands.Add(command)
-			}
-			stage := NewStage(stage_v.Name,
-				stage_v.Priority,
-				str2state(stage_v.State))
-			stage.AddCommands(commands)
-			build.AddStage(stage)
+		timeout, _ := str2duration(build_v.Timeout)
+		build := NewBuild(build_v.Name,
+			build_v.Directory,
+			build_v.Priority,
+			loadState(build_v.Name, build_v.State),
+			timeout,
+			build_v.Env)
+		build.config = build_v
+		build.pipeline_file = build_v.PipelineFile
+		build.source = build_v.Source
+		if build.source != nil {
+			// checkouts may clean or track anything in the directory
+			build.setLogDirectory(builder.runs.logsDirectory(builder.name, build.name))
+		}
+		build.webhook = build_v.Webhook
+		build.coalesce = build_v.Coalesce
+		build.parameters = build_v.Parameters
+		if build_v.Schedule != "" {
+			build.schedule, _ = newCronSchedule(build_v.Schedule, build_v.TimeZone, build_v.Jitter)
+			build.schedule_next = build.schedule.nextFire(time.Now())
+		}
+		for _, stage_v := range object.Builder.Builds[build_i].Stages {
+			build.AddStage(newStageFromBody(stage_v, build_v.Directory))
 		}
 		builder.AddBuild(build)
 	}
-	builder.SetIdle(false)
+	setLogOptions(builder.log_tail, builder.log_stream_tags)
 	return builder
 }
 
+func newStageFromBody(stage_v StageBody, build_dir string) *Stage {
+	commands := NewShellCommands()
+	for _, command_v := range stage_v.Commands {
+		timeout, _ := str2duration(command_v.Timeout)
+		command := NewShellCommand(command_v.Name,
+			command_v.Command,
+			command_v.Args,
+			command_v.Shell,
+			command_v.Directory,
+			build_dir,
+			timeout,
+			command_v.Env)
+		commands.Add(command)
+	}
+	timeout, _ := str2duration(stage_v.Timeout)
+	stage := NewStage(stage_v.Name,
+		stage_v.Priority,
+		loadState(stage_v.Name, stage_v.State),
+		timeout,
+		stage_v.Env,
+		stage_v.DependsOn)
+	stage.AddCommands(commands)
+	return stage
+}
+
+// reads the pipeline file of a build, returning its stages or everything
+// wrong with it
+func loadPipeline(file string, build_dir string) ([]*Stage, []error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, []error{err}
+	}
+	pipeline, errors := decodePipeline(file, content)
+	if len(errors) > 0 {
+		return nil, errors
+	}
+	var stages []*Stage
+	for _, stage_v := range pipeline.Stages {
+		// every run starts with all of them queued
+		stage_v.State = state2str(State_queued)
+		stages = append(stages, newStageFromBody(stage_v, build_dir))
+	}
+	return stages, nil
+}
+
 func UpdateJSONFromBuilder(builder *Builder, flag bool) {
 	// save to disk?
 	if !flag {
 		return
 	}
-	// build jsonobject from builder
-	var object jsonobject
+	// a whole snapshot is written before the next one is taken
+	save_mutex.Lock()
+	defer save_mutex.Unlock()
+	builder.mutex.Lock()
+	object := builder.configObject()
+	builder.mutex.Unlock()
+	// save to disk
+	saveJSON(object)
+}
+
+// the configuration as it is at runtime, must be called with the mutex held
+func (builder *Builder) configObject() (object jsonobject) {
 	object.Builder.Name = builder.name
+	object.Builder.MaxParallelBuilds = builder.max_parallel
+	object.Builder.DataDirectory = builder.data_dir
+	object.Builder.Env = builder.env
+	object.Builder.Coalesce = builder.coalesce
+	object.Builder.Tokens = builder.tokens
+	object.Builder.TokensFile = builder.tokens_file
+	object.Builder.Listen = builder.listen
+	tail_lines, stream_tags := logOptions()
+	if tail_lines != default_log_tail_lines {
+		object.Builder.LogTail = tail_lines
+	}
+	object.Builder.LogStreamTags = stream_tags
 	for _, build_v := range builder.builds {
-		var build_body BuildBody
-		build_body.Name = build_v.name
-		build_body.Directory = build_v.directory
-		build_body.Priority = build_v.priority
-		build_body.State = state2str(build_v.state)
-		for _, stage_v := range build_v.stages {
-			var stage_body StageBody
-			stage_body.Name = stage_v.name
-			stage_body.Priority = stage_v.priority
-			stage_body.State = state2str(stage_v.state)
-			for _, command_v := range stage_v.commands {
-				var command_body CommandBody
-				command_body.Name = command_v.name
-				command_body.Command = command_v.command
-				command_body.Args = command_v.params
-				command_body.Directory = command_v.dir
-				stage_body.Commands = append(stage_body.Commands, command_body)
-			}
-			build_body.Stages = append(build_body.Stages, stage_body)
+		object.Builder.Builds = append(object.Builder.Builds, build_v.configBody())
+	}
+	return object
+}
+
+// the configuration of a build as it is at runtime
+func (build *Build) configBody() (build_body BuildBody) {
+	build_body.Name = build.name
+	build_body.Directory = build.directory
+	build_body.Priority = build.priority
+	build_body.State = state2str(build.state)
+	build_body.Timeout = duration2str(build.timeout)
+	build_body.Env = build.env
+	build_body.PipelineFile = build.pipeline_file
+	build_body.Source = build.source
+	build_body.Webhook = build.webhook
+	build_body.Coalesce = build.coalesce
+	build_body.Parameters = build.parameters
+	if build.schedule != nil {
+		build_body.Schedule = build.schedule.spec
+		build_body.TimeZone = build.schedule.time_zone
+		build_body.Jitter = build.schedule.jitter_spec
+	}
+	for _, stage_v := range build.stages {
+		// stages of a pipeline file belong to the project
+		if build.pipeline_file != "" {
+			break
+		}
+		var stage_body StageBody
+		stage_body.Name = stage_v.name
+		stage_body.Priority = stage_v.priority
+		stage_body.State = state2str(stage_v.state)
+		stage_body.Timeout = duration2str(stage_v.timeout)
+		stage_body.Env = stage_v.env
+		stage_body.DependsOn = stage_v.depends_on
+		for _, command_v := range stage_v.commands {
+			var command_body CommandBody
+			command_body.Name = command_v.name
+			command_body.Command = command_v.command
+			command_body.Args = command_v.params
+			command_body.Shell = command_v.shell
+			command_body.Directory = command_v.dir
+			command_body.Timeout = duration2str(command_v.timeout)
+			command_body.Env = command_v.env
+			stage_body.Commands = append(stage_body.Commands, command_body)
 		}
-		object.Builder.Builds = append(object.Builder.Builds, build_body)
+		build_body.Stages = append(build_body.Stages, stage_body)
 	}
-	// save to disk
-	saveJSON(object, file_json+".new")
+	return build_body
 }
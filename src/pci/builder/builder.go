@@ -27,98 +27,395 @@
 package builder
 
 import (
+	"fmt"
 	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Builder state, and the state of its builds and stages, is guarded by mutex
 type Builder struct {
-	name    string
-	builds  []*Build
-	running bool
+	mutex        sync.Mutex
+	name         string
+	env          map[string]string
+	builds       []*Build
+	running      bool
+	max_parallel int
+	wake         chan bool
+	data_dir     string
+	runs         *runStore
+	// log options as configured, applied to every command
+	log_tail        int
+	log_stream_tags bool
+	// signalled when builds are queued while the main loop may be idle
+	triggers chan bool
+	// requested runs, and how duplicate requests are merged
+	queue        []*buildRequest
+	next_request int
+	coalesce     string
+	// tokens as configured, and with the ones of the tokens file
+	tokens      []TokenBody
+	tokens_file string
+	api_tokens  []TokenBody
+	// where the API is served, as configured
+	listen *ListenBody
 }
 
-func NewBuilder(name string) *Builder {
-	return &Builder{name: name, running: false}
+func NewBuilder(name string, env map[string]string, max_parallel int, data_dir string) *Builder {
+	return &Builder{name: name,
+		env:          env,
+		running:      false,
+		max_parallel: max_parallel,
+		wake:         make(chan bool, 1),
+		triggers:     make(chan bool, 1),
+		data_dir:     data_dir,
+		runs:         newRunStore(dataDirectory(data_dir))}
 }
 
 func (b *Builder) AddBuild(build *Build) {
 	b.builds = append(b.builds, build)
 }
 
-func (b *Builder) PickBuildByPriority() (winner *Build) {
-	var build *Build
-	var i int
-	winner = nil
-	for i, build = range b.builds {
-		if build.state == State_ready {
-			winner = build
-			i++
+// starts the build of the first queued request whose build isn't already
+// running. Lowest priority value wins, ties go to the oldest request.
+func (b *Builder) PickBuildByPriority() *Build {
+	b.adoptQueuedBuilds()
+	for _, request := range b.sortedQueue() {
+		build := b.getBuild(request.Build)
+		if build != nil && build.state == State_running {
+			continue
+		}
+		b.removeRequest(request.Id)
+		if build == nil {
+			continue
+		}
+		if build.state != State_queued {
+			logTransition(build.setState(State_queued))
+		}
+		if err := build.setState(State_running); err != nil {
+			logTransition(err)
+			continue
+		}
+		build.cancelled = false
+		build.request = request
+		return build
+	}
+	return nil
+}
+
+func (b *Builder) maxParallelBuilds() int {
+	if b.max_parallel < 1 {
+		return 1
+	}
+	return b.max_parallel
+}
+
+// picks the ready builds that fit in the free slots, must be called with
+// the mutex held
+func (b *Builder) Schedule(global_state *GlobalState) (started []*Build) {
+	for global_state.Running() < b.maxParallelBuilds() {
+		build := b.PickBuildByPriority()
+		if build == nil {
 			break
 		}
+		global_state.Add(build)
+		started = append(started, build)
 	}
-	if winner == nil {
-		return nil
+	return started
+}
+
+// runs every stage of a build as soon as its dependencies are done, so
+// independent stages run at the same time
+func (b *Builder) runBuild(build *Build, done chan *Build) {
+	ready := b.beginRun(build) && b.checkoutBuild(build) && b.readPipeline(build)
+	// a build cancelled while it was getting ready runs nothing
+	b.mutex.Lock()
+	cancelled := build.cancelled
+	b.mutex.Unlock()
+	switch {
+	case cancelled:
+		b.mutex.Lock()
+		logTransition(build.setState(State_cancelled))
+		b.mutex.Unlock()
+	case ready:
+		b.runStages(build)
+	default:
+		b.mutex.Lock()
+		logTransition(build.setState(State_failed))
+		b.mutex.Unlock()
 	}
-	for _, build = range b.builds[i:] {
-		if build.state == State_ready {
-			if build.priority < winner.priority {
-				winner = build
-				break
-			}
+	b.finishRun(build)
+	b.mutex.Lock()
+	b.retireBuild(build)
+	b.requeue(build.name)
+	b.mutex.Unlock()
+	UpdateJSONFromBuilder(b, on_disk)
+	done <- build
+}
+
+func (b *Builder) runStages(build *Build) {
+	finished := make(chan *Stage)
+	running := 0
+	for {
+		b.mutex.Lock()
+		runnable, skipped := build.PickRunnableStages()
+		for _, stage := range skipped {
+			log.Printf("Skipping %s %s", build.name, stage.name)
+		}
+		for _, stage := range runnable {
+			log.Printf("Executing %s %s", build.name, stage.name)
+			go func(stage *Stage) {
+				b.BuildStep(build, stage)
+				finished <- stage
+			}(stage)
+		}
+		running += len(runnable)
+		if running == 0 {
+			logTransition(build.setState(build.result()))
+			b.mutex.Unlock()
+			break
 		}
+		b.mutex.Unlock()
+		<-finished
+		running--
+		UpdateJSONFromBuilder(b, on_disk)
 	}
-	winner.state = State_building
-	return winner
 }
 
-func (b *Builder) Schedule(global_state *GlobalState) (build *Build, stage *Stage) {
-	if global_state.Current_build == nil {
-		build = b.PickBuildByPriority()
-	} else {
-		build = global_state.Current_build
+// replaces the stages of a build with those of its pipeline file. What is
+// wrong with the file goes to the build log and its run, and fails only
+// this build. A cancelled build keeps its cancelled stages.
+func (b *Builder) readPipeline(build *Build) bool {
+	if build.pipeline_file == "" {
+		return true
 	}
-	if build != nil {
-		global_state.Current_build = build
-		stage = build.PickStageByPriority()
-		if stage != nil {
-			stage.state = State_building
-		} else {
-			build.state = State_finished
-			global_state.Current_build = nil
+	file := build.pipeline_file
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(build.directory, file)
+	}
+	stages, errors := loadPipeline(file, build.directory)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(errors) > 0 {
+		var messages []string
+		for _, err := range errors {
+			log.Printf("error: build %s: %v", build.name, err)
+			build.log.WriteString(formatLine("", "error: "+err.Error()))
+			messages = append(messages, err.Error())
 		}
+		build.run.Error = strings.Join(messages, "\n")
+		return false
+	}
+	if build.cancelled {
+		return false
+	}
+	build.stages = nil
+	for _, stage := range stages {
+		build.AddStage(stage)
 	}
-	return build, stage
+	return true
 }
 
 func (b *Builder) BuildStep(build *Build, stage *Stage) {
-	stage.Execute()
-	stage.state = State_finished
-	if !stage.status {
-		for _, s := range build.stages {
-			s.state = State_finished
-		}
-		build.state = State_finished
+	b.mutex.Lock()
+	stage.started = time.Now()
+	env := b.stageEnvironment(build, stage)
+	var params map[string]string
+	if build.request != nil {
+		params = build.request.Parameters
+	}
+	cancel := stage.cancel
+	b.mutex.Unlock()
+	state := stage.Execute(build.timeout, env, params, cancel)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	stage.finished = time.Now()
+	if stage.cancelled {
+		state = State_cancelled
+	}
+	logTransition(stage.setState(state))
+	build.run.AddStage(stage)
+	b.saveRun(build)
+}
+
+// records a new run, which can't go on when the build log can't be opened
+func (b *Builder) beginRun(build *Build) bool {
+	log_err := build.openLog()
+	run, err := b.runs.Begin(b.name, build)
+	if err != nil {
+		log.Printf("error: run of %s not recorded: %v", build.name, err)
+		run = newBuildRun(0, build)
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	build.resetStages()
+	build.run = run
+	build.run_id = strconv.Itoa(run.Id)
+	build.ref, build.commit = "", ""
+	if request := build.request; request != nil {
+		build.ref, build.commit = request.Ref, request.Commit
+		run.Request = request.Id
+		run.Reason = request.Reason
+		run.Requester = request.Requester
+		run.Parameters = request.Parameters
+	}
+	run.Ref, run.Commit = build.ref, build.commit
+	if log_err != nil {
+		log.Printf("error: build %s: can't open its log: %v", build.name, log_err)
+		run.Error = log_err.Error()
+		return false
+	}
+	return true
+}
+
+// must be called with the mutex held
+func (b *Builder) saveRun(build *Build) {
+	if build.run.Id == 0 {
+		return
+	}
+	if err := b.runs.Save(b.name, build.run); err != nil {
+		log.Printf("error: run %d of %s not recorded: %v", build.run.Id, build.name, err)
+	}
+}
+
+func (b *Builder) CancelBuild(build *Build) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	queued := build.state == State_queued
+	if !build.Cancel() {
+		return fmt.Errorf("build %s is neither queued nor running", build.name)
+	}
+	if queued {
+		b.dropRequests(build.name)
+	}
+	log.Printf("Cancelling %s", build.name)
+	return nil
+}
+
+func (b *Builder) CancelStage(build *Build, stage *Stage) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if build.state != State_running || !stage.Cancel() {
+		return fmt.Errorf("stage %s is neither queued nor running", stage.name)
+	}
+	log.Printf("Cancelling %s %s", build.name, stage.name)
+	return nil
+}
+
+// recorded runs of a build, newest first, see runStore.List
+func (b *Builder) BuildRuns(build *Build, state string, limit int) ([]*BuildRun, error) {
+	b.mutex.Lock()
+	runs, builder_name, build_name := b.runs, b.name, build.name
+	b.mutex.Unlock()
+	return runs.List(builder_name, build_name, state, limit)
+}
+
+func (b *Builder) BuildRun(build *Build, id int) (*BuildRun, error) {
+	b.mutex.Lock()
+	runs, builder_name, build_name := b.runs, b.name, build.name
+	b.mutex.Unlock()
+	return runs.Get(builder_name, build_name, id)
+}
+
+// the run in memory once the build ran since it was loaded, else the
+// newest recorded one. Must be called with the mutex held
+func (b *Builder) lastRun(build *Build) *BuildRun {
+	if build.run != nil {
+		return build.run.redacted()
+	}
+	runs, err := b.runs.List(b.name, build.name, "", 1)
+	if err != nil {
+		log.Printf("error: can't read the runs of %s: %v", build.name, err)
+		return nil
+	}
+	if len(runs) == 0 {
+		return nil
+	}
+	return runs[0].redacted()
+}
+
+func (b *Builder) finishRun(build *Build) {
+	b.mutex.Lock()
+	build.run.Finish(build)
+	b.saveRun(build)
+	b.mutex.Unlock()
+	if err := build.log.Close(); err != nil {
+		log.Printf("error: build %s: can't write its log: %v", build.name, err)
 	}
 }
 
+// environment shared by every command of a stage, built-in variables last
+func (b *Builder) stageEnvironment(build *Build, stage *Stage) map[string]string {
+	return mergeEnvironments(b.env, build.env, stage.env, map[string]string{
+		"PCI_BUILDER_NAME": b.name,
+		"PCI_BUILD_NAME":   build.name,
+		"PCI_BUILD_DIR":    build.directory,
+		"PCI_RUN_ID":       build.run_id,
+		"PCI_REF":          build.ref,
+		"PCI_COMMIT":       build.commit,
+		"PCI_STAGE_NAME":   stage.name})
+}
+
+// RunStage returns the scheduler step. Every call starts as many ready
+// builds as there are free slots and waits until one of the builds in flight
+// finishes or Wake is called. It returns false once there is nothing left
+// to do. Steps must be run one at a time, by a single dispatcher.
 func (b *Builder) RunStage() func() bool {
 	global_state := NewGlobalState()
 	return func() bool {
-		build, stage := b.Schedule(global_state)
-		if stage != nil {
-			log.Printf("Executing %s %s", build.name, stage.name)
-			b.BuildStep(build, stage)
+		b.mutex.Lock()
+		for _, build := range b.Schedule(global_state) {
+			go b.runBuild(build, global_state.Done)
 		}
-		if build == nil {
-			builder.SetIdle(true)
+		in_flight := global_state.Running()
+		b.running = in_flight > 0
+		b.mutex.Unlock()
+		if in_flight == 0 {
 			return false
-		} else {
-			builder.SetIdle(false)
-			UpdateJSONFromBuilder(b, on_disk)
-			return true
 		}
+		select {
+		case build := <-global_state.Done:
+			global_state.Remove(build)
+		case <-b.wake:
+		}
+		return true
 	}
 }
 
+// tells the main loop that builds were queued
+func (b *Builder) trigger() {
+	select {
+	case b.triggers <- true:
+	default:
+	}
+}
+
+// Triggers signals builds queued while the main loop may be idle
+func (b *Builder) Triggers() <-chan bool {
+	return b.triggers
+}
+
+// Wake makes a busy scheduler look for new ready builds
+func (b *Builder) Wake() {
+	select {
+	case b.wake <- true:
+	default:
+	}
+}
+
+// builds currently running
+func (b *Builder) InFlight() (builds []*Build) {
+	for _, build := range b.builds {
+		if build.state == State_running {
+			builds = append(builds, build)
+		}
+	}
+	return builds
+}
+
 func (b *Builder) GetBuildsByState(state int) []*Build {
 	log.Printf("--> ")
 	for _, build := range b.builds {
@@ -131,22 +428,49 @@ func (b *Builder) GetBuildsByState(state int) []*Build {
 
 var on_disk bool = false
 
+// overrides the data directory of the configuration when set
+var data_dir_override string = ""
+
+func (b *Builder) SetDataDirectory(data_dir *string) {
+	if *data_dir == "" {
+		return
+	}
+	data_dir_override = *data_dir
+	b.runs = newRunStore(dataDirectory(b.data_dir))
+	for _, build := range b.builds {
+		if build.source != nil {
+			build.setLogDirectory(b.runs.logsDirectory(b.name, build.name))
+		}
+	}
+}
+
 func (b *Builder) UpdateOnDisk(update_json *bool) {
 	// we want on_disk being global while related to Builder
 	on_disk = *update_json
 }
 
+func (b *Builder) SaveInPlace(in_place *bool, backups *int) {
+	save_in_place = *in_place
+	save_backups = *backups
+}
+
 func (b *Builder) IsIdle() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 	return !b.running
 }
 
 func (b *Builder) SetIdle(v bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 	b.running = !v
 }
 
+// Reload replaces the builds with the ones on disk. It is only called while
+// idle, so there is nothing in flight to disturb.
 func (b *Builder) Reload() func() bool {
-	builder := NewBuilderFromCurrentJSON()
-	runNextStage := builder.RunStage()
-	UpdateJSONFromBuilder(builder, on_disk)
+	b.ReloadConfig(false)
+	runNextStage := b.RunStage()
+	UpdateJSONFromBuilder(b, on_disk)
 	return runNextStage
 }
@@ -0,0 +1,122 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const default_log_tail_lines = 100
+
+// lines of output kept in memory by every command, none if negative
+var log_tail_lines int = default_log_tail_lines
+
+// prefix every line with the stream (out/err) it was read from
+var log_stream_tags bool = false
+
+const log_time_format = "2006-01-02 15:04:05.000"
+
+// longer output without a newline is split into lines of this size
+const max_line_length = 64 * 1024
+
+// lineWriter splits what a process writes into lines and hands each of them
+// to its command as soon as it is complete
+type lineWriter struct {
+	command *shellCommand
+	tag     string
+	partial []byte
+}
+
+func newLineWriter(command *shellCommand, tag string) *lineWriter {
+	return &lineWriter{command: command, tag: tag}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.command.writeLine(w.tag, string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+	for len(w.partial) >= max_line_length {
+		w.command.writeLine(w.tag, string(w.partial[:max_line_length]))
+		w.partial = w.partial[max_line_length:]
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) Flush() {
+	if len(w.partial) > 0 {
+		w.command.writeLine(w.tag, string(w.partial))
+		w.partial = nil
+	}
+}
+
+func formatLine(tag string, line string) string {
+	now := time.Now().Format(log_time_format)
+	if _, stream_tags := logOptions(); stream_tags && tag != "" {
+		return fmt.Sprintf("%s [%s] %s\n", now, tag, line)
+	}
+	return fmt.Sprintf("%s %s\n", now, line)
+}
+
+// the options can change on a reload while commands write their output
+var log_options_mutex sync.Mutex
+
+func logOptions() (int, bool) {
+	log_options_mutex.Lock()
+	defer log_options_mutex.Unlock()
+	return log_tail_lines, log_stream_tags
+}
+
+func setLogOptions(tail_lines int, stream_tags bool) {
+	log_options_mutex.Lock()
+	defer log_options_mutex.Unlock()
+	log_tail_lines = tail_lines
+	if log_tail_lines == 0 {
+		log_tail_lines = default_log_tail_lines
+	}
+	log_stream_tags = stream_tags
+}
+
+func appendTail(tail []string, line string) []string {
+	tail_lines, _ := logOptions()
+	if tail_lines <= 0 {
+		return nil
+	}
+	tail = append(tail, line)
+	if len(tail) > tail_lines {
+		tail = tail[len(tail)-tail_lines:]
+	}
+	return tail
+}
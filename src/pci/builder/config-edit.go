@@ -0,0 +1,218 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+)
+
+// configEdit is a change to the builds, stages or commands of the
+// configuration, as asked for over HTTP
+type configEdit struct {
+	// POST adds an element, PUT replaces it, PATCH merges a JSON patch
+	// into it and DELETE removes it
+	method string
+	// the build and stage whose list is edited, both empty for the builds
+	build string
+	stage string
+	// the element edited, empty when one is added
+	name    string
+	content []byte
+}
+
+func (e *configEdit) kind() string {
+	switch {
+	case e.build == "":
+		return "build"
+	case e.stage == "":
+		return "stage"
+	}
+	return "command"
+}
+
+// the build whose configuration changes, empty for a new one
+func (e *configEdit) target() string {
+	if e.build != "" {
+		return e.build
+	}
+	return e.name
+}
+
+// the list holding the element edited
+func (e *configEdit) list(object *jsonobject) (reflect.Value, *httpError) {
+	builds := reflect.ValueOf(&object.Builder.Builds).Elem()
+	if e.build == "" {
+		return builds, nil
+	}
+	i := indexByName(builds, e.build)
+	if i < 0 {
+		return builds, newHttpError(http.StatusNotFound, "build %s doesn't exist", e.build)
+	}
+	build := &object.Builder.Builds[i]
+	if build.PipelineFile != "" {
+		return builds, newHttpError(http.StatusBadRequest, "the stages of build %s come from its pipeline file", e.build)
+	}
+	stages := reflect.ValueOf(&build.Stages).Elem()
+	if e.stage == "" {
+		return stages, nil
+	}
+	j := indexByName(stages, e.stage)
+	if j < 0 {
+		return stages, newHttpError(http.StatusNotFound, "stage %s doesn't exist", e.stage)
+	}
+	return reflect.ValueOf(&build.Stages[j].Commands).Elem(), nil
+}
+
+func indexByName(list reflect.Value, name string) int {
+	for i := 0; i < list.Len(); i++ {
+		if list.Index(i).FieldByName("Name").String() == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// EditConfig changes the configuration, checks the result the way a
+// configuration file is checked and puts it in place the way a reload
+// does. A running build can't be changed. It returns the element as it
+// ends up, or as it was when it is deleted.
+func (b *Builder) EditConfig(edit *configEdit) (interface{}, []error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if build := b.getBuild(edit.target()); build != nil && build.state == State_running {
+		return nil, []error{newHttpError(http.StatusConflict, "build %s is running", build.name)}
+	}
+	object := b.editableConfig(edit.target())
+	list, herr := edit.list(&object)
+	if herr != nil {
+		return nil, []error{herr}
+	}
+	element, errors := edit.apply(list)
+	if len(errors) > 0 {
+		return nil, errors
+	}
+	v := &configValidator{}
+	v.validateBuilder(&object.Builder)
+	if len(v.errors) > 0 {
+		return nil, v.sortedErrors()
+	}
+	b.applyConfig(newBuilderFromObject(object))
+	return element, nil
+}
+
+// the configuration to edit, with the build edited as it is at runtime and
+// the others as they were loaded, so that they are left alone. Only the
+// lists of the build edited are fresh, the others must not be changed.
+func (b *Builder) editableConfig(edited string) jsonobject {
+	object := b.configObject()
+	for i, build := range b.builds {
+		if build.name != edited {
+			object.Builder.Builds[i] = build.config
+		}
+	}
+	return object
+}
+
+func (e *configEdit) apply(list reflect.Value) (interface{}, []error) {
+	index := -1
+	if e.name != "" {
+		if index = indexByName(list, e.name); index < 0 {
+			return nil, []error{newHttpError(http.StatusNotFound, "%s %s doesn't exist", e.kind(), e.name)}
+		}
+	}
+	content := e.content
+	switch e.method {
+	case "DELETE":
+		removed := list.Index(index).Interface()
+		list.Set(reflect.AppendSlice(list.Slice(0, index), list.Slice(index+1, list.Len())))
+		return removed, nil
+	case "PATCH":
+		current, _ := json.Marshal(list.Index(index).Interface())
+		var err error
+		if content, err = mergePatch(current, content); err != nil {
+			return nil, []error{newHttpError(http.StatusBadRequest, "invalid patch: %v", err)}
+		}
+	}
+	element := reflect.New(list.Type().Elem())
+	v := &configValidator{file: "request"}
+	if !v.decode(content, element.Interface()) || len(v.errors) > 0 {
+		return nil, v.sortedErrors()
+	}
+	// the name of the URL is the default one
+	name := element.Elem().FieldByName("Name")
+	if name.String() == "" {
+		name.SetString(e.name)
+	}
+	if e.method == "POST" {
+		if indexByName(list, name.String()) >= 0 {
+			return nil, []error{newHttpError(http.StatusConflict, "%s %s already exists", e.kind(), name.String())}
+		}
+		list.Set(reflect.Append(list, element.Elem()))
+	} else {
+		list.Index(index).Set(element.Elem())
+	}
+	return element.Elem().Interface(), nil
+}
+
+// merges a JSON merge patch (RFC 7396) into a JSON document: members of
+// objects are merged, null removes them and anything else is replaced
+func mergePatch(document []byte, patch []byte) ([]byte, error) {
+	var target, changes interface{}
+	for _, v := range []struct {
+		content []byte
+		value   *interface{}
+	}{{document, &target}, {patch, &changes}} {
+		dec := json.NewDecoder(bytes.NewReader(v.content))
+		dec.UseNumber()
+		if err := dec.Decode(v.value); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(mergeValue(target, changes))
+}
+
+func mergeValue(target interface{}, patch interface{}) interface{} {
+	changes, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	merged, ok := target.(map[string]interface{})
+	if !ok {
+		merged = make(map[string]interface{})
+	}
+	for key, value := range changes {
+		if value == nil {
+			delete(merged, key)
+			continue
+		}
+		merged[key] = mergeValue(merged[key], value)
+	}
+	return merged
+}
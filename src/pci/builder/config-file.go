@@ -0,0 +1,334 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// a JSON object that keeps the order of its keys, so saving a
+// configuration doesn't move what people wrote by hand
+type orderedObject []orderedMember
+
+// comments are the '#' lines written before the member in YAML and TOML,
+// and inline the one at the end of its line
+type orderedMember struct {
+	key      string
+	value    interface{}
+	comments []string
+	inline   string
+}
+
+func (o orderedObject) get(key string) (interface{}, bool) {
+	for _, m := range o {
+		if m.key == key {
+			return m.value, true
+		}
+	}
+	return nil, false
+}
+
+func parseOrdered(content []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.UseNumber()
+	return decodeOrdered(dec)
+}
+
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		object := orderedObject{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			object = append(object, orderedMember{key: key.(string), value: value})
+		}
+		_, err = dec.Token()
+		return object, err
+	case json.Delim('['):
+		array := []interface{}{}
+		for dec.More() {
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err = dec.Token()
+		return array, err
+	}
+	return tok, nil
+}
+
+func encodeOrdered(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case orderedObject:
+		buf.WriteByte('{')
+		for i, m := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(strconv.Quote(m.key))
+			buf.WriteByte(':')
+			if err := encodeOrdered(buf, m.value); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeOrdered(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		content, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(content)
+	}
+	return nil
+}
+
+// takes the values of updated and keeps from original the comments and the
+// order of its keys. Array elements are matched by their Name.
+func mergeOrdered(original interface{}, updated interface{}) interface{} {
+	switch u := updated.(type) {
+	case orderedObject:
+		o, ok := original.(orderedObject)
+		if !ok {
+			return u
+		}
+		merged := orderedObject{}
+		for _, m := range o {
+			if value, ok := u.get(m.key); ok {
+				m.value = mergeOrdered(m.value, value)
+				merged = append(merged, m)
+			} else if isCommentKey(m.key) {
+				merged = append(merged, m)
+			}
+		}
+		for _, m := range u {
+			if _, ok := o.get(m.key); !ok {
+				merged = append(merged, m)
+			}
+		}
+		return merged
+	case []interface{}:
+		o, ok := original.([]interface{})
+		if !ok {
+			return u
+		}
+		merged := []interface{}{}
+		for _, e := range u {
+			merged = append(merged, mergeOrdered(namedElement(o, e), e))
+		}
+		return merged
+	}
+	return updated
+}
+
+func namedElement(array []interface{}, like interface{}) interface{} {
+	object, ok := like.(orderedObject)
+	if !ok {
+		return nil
+	}
+	name, ok := object.get("Name")
+	if !ok {
+		return nil
+	}
+	for _, e := range array {
+		if o, ok := e.(orderedObject); ok {
+			if n, ok := o.get("Name"); ok && n == name {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+const (
+	format_json = "json"
+	format_yaml = "yaml"
+	format_toml = "toml"
+)
+
+// the format of a configuration file is given by its extension
+func configFormat(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return format_yaml
+	case ".toml":
+		return format_toml
+	}
+	return format_json
+}
+
+// parses a configuration in any format into an ordered tree, with the line
+// of every JSON path when the format isn't JSON
+func parseConfig(format string, content []byte) (interface{}, map[string]int, error) {
+	switch format {
+	case format_yaml:
+		return parseYAML(content)
+	case format_toml:
+		return parseTOML(content)
+	}
+	tree, err := parseOrdered(content)
+	return tree, nil, err
+}
+
+// renders object in format, laid out like the file it replaces when that
+// file can be read
+func formatConfig(object interface{}, original []byte, format string) ([]byte, error) {
+	content, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := parseOrdered(content)
+	if err != nil {
+		return nil, err
+	}
+	if original != nil {
+		if tree, _, err := parseConfig(format, original); err == nil {
+			updated = mergeOrdered(tree, updated)
+		}
+	}
+	switch format {
+	case format_yaml:
+		return formatYAML(updated)
+	case format_toml:
+		return formatTOML(updated)
+	}
+	var compact, indented bytes.Buffer
+	if err := encodeOrdered(&compact, updated); err != nil {
+		return nil, err
+	}
+	if err := json.Indent(&indented, compact.Bytes(), "", "   "); err != nil {
+		return nil, err
+	}
+	indented.WriteByte('\n')
+	return indented.Bytes(), nil
+}
+
+// replaces file with content through a synced temporary file, so a crash
+// leaves either the old or the new version
+func writeFileAtomic(file string, content []byte, perm os.FileMode) error {
+	dir := filepath.Dir(file)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return err
+	}
+	return syncDirectory(dir)
+}
+
+func syncDirectory(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// keeps file.1 (newest) to file.N with the versions being replaced
+func rotateBackups(file string, content []byte, perm os.FileMode, backups int) error {
+	if backups < 1 {
+		return nil
+	}
+	for i := backups - 1; i > 0; i-- {
+		older := fmt.Sprintf("%s.%d", file, i)
+		if ok, _ := exists(older); ok {
+			if err := os.Rename(older, fmt.Sprintf("%s.%d", file, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return writeFileAtomic(file+".1", content, perm)
+}
+
+// formatError is a syntax error in a YAML or TOML file
+type formatError struct {
+	line    int
+	message string
+}
+
+func (e *formatError) Error() string {
+	return e.message
+}
+
+func newFormatError(line int, format string, args ...interface{}) error {
+	return &formatError{line: line, message: fmt.Sprintf(format, args...)}
+}
+
+func formatErrorLine(err error) int {
+	if e, ok := err.(*formatError); ok {
+		return e.line
+	}
+	return 0
+}
@@ -0,0 +1,192 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// editors often write a file in several steps
+const reload_delay = 200 * time.Millisecond
+
+// reloads the configuration when its file changes or on SIGHUP. Every
+// reload that changed something is signalled on the returned channel.
+func (b *Builder) WatchConfig() <-chan bool {
+	changed := make(chan bool, 1)
+	events := make(chan bool, 1)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Printf("SIGHUP received")
+			notify(events, true)
+		}
+	}()
+	if err := watchFile(file_json, events); err != nil {
+		log.Printf("error: not watching '%s': %v", file_json, err)
+	}
+	go func() {
+		for forced := range events {
+			time.Sleep(reload_delay)
+			select {
+			case more := <-events:
+				forced = forced || more
+			default:
+			}
+			if b.ReloadConfig(forced) {
+				notify(changed, true)
+			}
+		}
+	}()
+	return changed
+}
+
+func notify(c chan bool, v bool) {
+	select {
+	case c <- v:
+	default:
+		// a reload is already pending; keep a forced one forced
+		if v {
+			select {
+			case <-c:
+			default:
+			}
+			notify(c, v)
+		}
+	}
+}
+
+// applies what changed in the configuration file. Our own writes are
+// skipped unless forced, and a rejected file leaves everything as it was.
+func (b *Builder) ReloadConfig(forced bool) bool {
+	content, err := ioutil.ReadFile(file_json)
+	if err != nil {
+		log.Printf("error: can't reload '%s': %v", file_json, err)
+		return false
+	}
+	if !forced && isConfigContent(content) {
+		return false
+	}
+	fresh, ok := loadBuilder(file_json)
+	if !ok {
+		log.Printf("error: configuration rejected, keeping the current one")
+		return false
+	}
+	b.mutex.Lock()
+	b.applyConfig(fresh)
+	b.mutex.Unlock()
+	b.Wake()
+	return true
+}
+
+func (b *Builder) getBuild(name string) *Build {
+	for _, build := range b.builds {
+		if build.name == name {
+			return build
+		}
+	}
+	return nil
+}
+
+// adds, removes and replaces builds. Running builds keep going and take
+// their new configuration once their run finishes. Must be called with the
+// mutex held.
+func (b *Builder) applyConfig(fresh *Builder) {
+	b.name = fresh.name
+	b.env = fresh.env
+	b.max_parallel = fresh.max_parallel
+	b.log_tail = fresh.log_tail
+	b.log_stream_tags = fresh.log_stream_tags
+	b.coalesce = fresh.coalesce
+	b.tokens = fresh.tokens
+	b.tokens_file = fresh.tokens_file
+	b.api_tokens = fresh.api_tokens
+	// the API keeps listening where it started
+	b.listen = fresh.listen
+	if fresh.data_dir != b.data_dir {
+		b.data_dir = fresh.data_dir
+		b.runs = fresh.runs
+	}
+	var builds []*Build
+	for _, build := range b.builds {
+		next := fresh.getBuild(build.name)
+		switch {
+		case next == nil && build.state == State_running:
+			log.Printf("Removing build %s once its run finishes", build.name)
+			build.pending = nil
+			build.removed = true
+			builds = append(builds, build)
+		case next == nil:
+			log.Printf("Removing build %s", build.name)
+			b.dropRequests(build.name)
+		case reflect.DeepEqual(next.config, build.config):
+			build.pending = nil
+			build.removed = false
+			builds = append(builds, build)
+		case build.state == State_running:
+			log.Printf("Updating build %s once its run finishes", build.name)
+			build.pending = next
+			build.removed = false
+			builds = append(builds, build)
+		default:
+			log.Printf("Updating build %s", build.name)
+			builds = append(builds, next)
+		}
+	}
+	for _, next := range fresh.builds {
+		if b.getBuild(next.name) == nil {
+			log.Printf("Adding build %s", next.name)
+			builds = append(builds, next)
+		}
+	}
+	b.builds = builds
+}
+
+// applies what a reload left for a build whose run just finished, must be
+// called with the mutex held
+func (b *Builder) retireBuild(build *Build) {
+	for i, current := range b.builds {
+		if current != build {
+			continue
+		}
+		switch {
+		case build.removed:
+			log.Printf("Removing build %s", build.name)
+			b.builds = append(b.builds[:i], b.builds[i+1:]...)
+		case build.pending != nil:
+			log.Printf("Updating build %s", build.name)
+			b.builds[i] = build.pending
+		}
+		return
+	}
+}
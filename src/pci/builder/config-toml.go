@@ -0,0 +1,683 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// TOML without dates and times, which configurations don't use
+
+type tomlTable struct {
+	path    string
+	members []*tomlMember
+	// created by a dotted header, it may still be defined by its own
+	implicit bool
+	// comments before an [[array]] header go to its first member
+	comments []string
+}
+
+type tomlMember struct {
+	key      string
+	value    interface{}
+	comments []string
+	inline   string
+}
+
+type tomlTables struct {
+	tables []*tomlTable
+}
+
+type tomlParser struct {
+	text     string
+	i        int
+	lines    map[string]int
+	comments []string
+	last     *tomlMember
+}
+
+func (t *tomlTable) get(key string) *tomlMember {
+	for _, m := range t.members {
+		if m.key == key {
+			return m
+		}
+	}
+	return nil
+}
+
+func (t *tomlTable) add(m *tomlMember) {
+	if len(t.members) == 0 && len(t.comments) > 0 {
+		m.comments = append(t.comments, m.comments...)
+		t.comments = nil
+	}
+	t.members = append(t.members, m)
+}
+
+func (t *tomlTable) ordered() orderedObject {
+	object := orderedObject{}
+	for _, m := range t.members {
+		value := m.value
+		switch v := m.value.(type) {
+		case *tomlTable:
+			value = v.ordered()
+		case *tomlTables:
+			array := []interface{}{}
+			for _, table := range v.tables {
+				array = append(array, table.ordered())
+			}
+			value = array
+		}
+		object = append(object, orderedMember{key: m.key,
+			value:    value,
+			comments: m.comments,
+			inline:   m.inline})
+	}
+	return object
+}
+
+func parseTOML(content []byte) (interface{}, map[string]int, error) {
+	p := &tomlParser{text: strings.Replace(string(content), "\r\n", "\n", -1),
+		lines: map[string]int{"": 1}}
+	root := &tomlTable{}
+	current := root
+	for {
+		p.space()
+		if p.i == len(p.text) {
+			return root.ordered(), p.lines, nil
+		}
+		var err error
+		switch p.text[p.i] {
+		case '\n':
+			p.i++
+			continue
+		case '#':
+			p.comments = append(p.comments, p.comment())
+			continue
+		case '[':
+			p.last = nil
+			current, err = p.header(root)
+		default:
+			err = p.keyValue(current)
+		}
+		if err == nil {
+			err = p.endOfLine()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func (p *tomlParser) line() int {
+	return strings.Count(p.text[:p.i], "\n") + 1
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return newFormatError(p.line(), format, args...)
+}
+
+func (p *tomlParser) space() {
+	for p.i < len(p.text) && (p.text[p.i] == ' ' || p.text[p.i] == '\t') {
+		p.i++
+	}
+}
+
+// skips blanks, newlines and comments inside arrays
+func (p *tomlParser) spaceAndLines() {
+	for {
+		p.space()
+		switch {
+		case p.i < len(p.text) && p.text[p.i] == '\n':
+			p.i++
+		case p.i < len(p.text) && p.text[p.i] == '#':
+			p.comment()
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) comment() string {
+	end := strings.IndexByte(p.text[p.i:], '\n')
+	if end < 0 {
+		end = len(p.text) - p.i
+	}
+	comment := strings.TrimRight(p.text[p.i:p.i+end], " \t")
+	p.i += end
+	return comment
+}
+
+func (p *tomlParser) endOfLine() error {
+	p.space()
+	if p.i < len(p.text) && p.text[p.i] == '#' {
+		comment := p.comment()
+		if p.last != nil {
+			p.last.inline = comment
+		}
+	}
+	if p.i < len(p.text) && p.text[p.i] != '\n' {
+		return p.errorf("expected the end of the line, found '%s'", p.rest())
+	}
+	return nil
+}
+
+func (p *tomlParser) rest() string {
+	end := strings.IndexByte(p.text[p.i:], '\n')
+	if end < 0 {
+		return p.text[p.i:]
+	}
+	return p.text[p.i : p.i+end]
+}
+
+func (p *tomlParser) takeComments() []string {
+	comments := p.comments
+	p.comments = nil
+	return comments
+}
+
+var toml_bare_key = regexp.MustCompile(`^[A-Za-z0-9_-]+`)
+
+// a dotted key, up to '=' or ']'
+func (p *tomlParser) key() ([]string, error) {
+	var keys []string
+	for {
+		p.space()
+		var key string
+		switch {
+		case p.i < len(p.text) && (p.text[p.i] == '"' || p.text[p.i] == '\''):
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			key = value.(string)
+		default:
+			bare := toml_bare_key.FindString(p.text[p.i:])
+			if bare == "" {
+				return nil, p.errorf("invalid key '%s'", p.rest())
+			}
+			key = bare
+			p.i += len(bare)
+		}
+		keys = append(keys, key)
+		p.space()
+		if p.i == len(p.text) || p.text[p.i] != '.' {
+			return keys, nil
+		}
+		p.i++
+	}
+}
+
+func (p *tomlParser) expect(c byte) error {
+	p.space()
+	if p.i == len(p.text) || p.text[p.i] != c {
+		return p.errorf("expected '%c'", c)
+	}
+	p.i++
+	return nil
+}
+
+// the table a dotted key goes through, created when missing
+func (p *tomlParser) descend(table *tomlTable, key string) (*tomlTable, error) {
+	m := table.get(key)
+	if m == nil {
+		child := &tomlTable{path: joinPath(table.path, key), implicit: true}
+		table.add(&tomlMember{key: key, value: child})
+		p.lines[child.path] = p.line()
+		return child, nil
+	}
+	switch v := m.value.(type) {
+	case *tomlTable:
+		return v, nil
+	case *tomlTables:
+		return v.tables[len(v.tables)-1], nil
+	}
+	return nil, p.errorf("%s is not a table", joinPath(table.path, key))
+}
+
+func (p *tomlParser) header(root *tomlTable) (*tomlTable, error) {
+	number := p.line()
+	p.i++
+	array := p.i < len(p.text) && p.text[p.i] == '['
+	if array {
+		p.i++
+	}
+	keys, err := p.key()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(']'); err != nil {
+		return nil, err
+	}
+	if array {
+		if p.i == len(p.text) || p.text[p.i] != ']' {
+			return nil, p.errorf("expected ']]'")
+		}
+		p.i++
+	}
+	table := root
+	for _, key := range keys[:len(keys)-1] {
+		if table, err = p.descend(table, key); err != nil {
+			return nil, err
+		}
+	}
+	last := keys[len(keys)-1]
+	path := joinPath(table.path, last)
+	m := table.get(last)
+	if array {
+		if m == nil {
+			m = &tomlMember{key: last, value: &tomlTables{}}
+			table.add(m)
+			p.lines[path] = number
+		}
+		tables, ok := m.value.(*tomlTables)
+		if !ok {
+			return nil, newFormatError(number, "%s is already defined", path)
+		}
+		child := &tomlTable{path: indexPath(path, len(tables.tables)), comments: p.takeComments()}
+		tables.tables = append(tables.tables, child)
+		p.lines[child.path] = number
+		return child, nil
+	}
+	if m == nil {
+		child := &tomlTable{path: path}
+		table.add(&tomlMember{key: last, value: child, comments: p.takeComments()})
+		p.lines[path] = number
+		return child, nil
+	}
+	if child, ok := m.value.(*tomlTable); ok && child.implicit {
+		child.implicit = false
+		m.comments = append(m.comments, p.takeComments()...)
+		return child, nil
+	}
+	return nil, newFormatError(number, "%s is defined twice", path)
+}
+
+func (p *tomlParser) keyValue(table *tomlTable) error {
+	number := p.line()
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+	if err := p.expect('='); err != nil {
+		return err
+	}
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys[:len(keys)-1] {
+		if table, err = p.descend(table, key); err != nil {
+			return err
+		}
+	}
+	last := keys[len(keys)-1]
+	if table.get(last) != nil {
+		return newFormatError(number, "duplicate key %s", joinPath(table.path, last))
+	}
+	p.last = &tomlMember{key: last, value: value, comments: p.takeComments()}
+	table.add(p.last)
+	p.lines[joinPath(table.path, last)] = number
+	return nil
+}
+
+func (p *tomlParser) value() (interface{}, error) {
+	p.space()
+	if p.i == len(p.text) {
+		return nil, p.errorf("missing value")
+	}
+	switch {
+	case strings.HasPrefix(p.text[p.i:], `"""`):
+		return p.multiLineString(`"""`)
+	case strings.HasPrefix(p.text[p.i:], `'''`):
+		return p.multiLineString(`'''`)
+	case p.text[p.i] == '"':
+		return p.basicString()
+	case p.text[p.i] == '\'':
+		end := strings.IndexAny(p.text[p.i+1:], "'\n")
+		if end < 0 || p.text[p.i+1+end] != '\'' {
+			return nil, p.errorf("unterminated string")
+		}
+		str := p.text[p.i+1 : p.i+1+end]
+		p.i += end + 2
+		return str, nil
+	case p.text[p.i] == '[':
+		return p.array()
+	case p.text[p.i] == '{':
+		return p.inlineTable()
+	}
+	start := p.i
+	for p.i < len(p.text) && strings.IndexByte("+-_.0123456789abcdefoxABCDEFinatrulsE", p.text[p.i]) >= 0 {
+		p.i++
+	}
+	word := p.text[start:p.i]
+	switch word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	number := strings.Replace(word, "_", "", -1)
+	if n, err := strconv.ParseInt(number, 0, 64); err == nil && !isLegacyOctal(number) {
+		return json.Number(strconv.FormatInt(n, 10)), nil
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil && !strings.ContainsAny(number, "xXin") {
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+	}
+	p.i = start
+	return nil, p.errorf("invalid value '%s'", p.rest())
+}
+
+// Go reads a leading zero as octal, TOML doesn't allow it
+func isLegacyOctal(number string) bool {
+	number = strings.TrimLeft(number, "+-")
+	return len(number) > 1 && number[0] == '0' && number[1] >= '0' && number[1] <= '9'
+}
+
+func (p *tomlParser) basicString() (interface{}, error) {
+	var buf strings.Builder
+	for p.i++; p.i < len(p.text); p.i++ {
+		c := p.text[p.i]
+		switch c {
+		case '"':
+			p.i++
+			return buf.String(), nil
+		case '\n':
+			return nil, p.errorf("unterminated string")
+		case '\\':
+			if err := p.escape(&buf); err != nil {
+				return nil, err
+			}
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return nil, p.errorf("unterminated string")
+}
+
+// decodes the escape at p.i, leaving p.i on its last character
+func (p *tomlParser) escape(buf *strings.Builder) error {
+	if p.i+1 == len(p.text) {
+		return p.errorf("unterminated string")
+	}
+	p.i++
+	switch c := p.text[p.i]; c {
+	case 'b':
+		buf.WriteByte('\b')
+	case 't':
+		buf.WriteByte('\t')
+	case 'n':
+		buf.WriteByte('\n')
+	case 'f':
+		buf.WriteByte('\f')
+	case 'r':
+		buf.WriteByte('\r')
+	case 'e':
+		buf.WriteByte(0x1b)
+	case '"', '\\':
+		buf.WriteByte(c)
+	case 'u', 'U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		if p.i+size >= len(p.text) {
+			return p.errorf("invalid escape")
+		}
+		r, err := strconv.ParseUint(p.text[p.i+1:p.i+1+size], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return p.errorf("invalid escape")
+		}
+		buf.WriteRune(rune(r))
+		p.i += size
+	default:
+		return p.errorf("invalid escape '\\%c'", c)
+	}
+	return nil
+}
+
+func (p *tomlParser) multiLineString(delimiter string) (interface{}, error) {
+	p.i += len(delimiter)
+	// a newline right after the delimiter isn't part of the string
+	if p.i < len(p.text) && p.text[p.i] == '\n' {
+		p.i++
+	}
+	var buf strings.Builder
+	for ; p.i < len(p.text); p.i++ {
+		if strings.HasPrefix(p.text[p.i:], delimiter) {
+			// up to two quotes may end the string before its delimiter
+			for strings.HasPrefix(p.text[p.i+1:], delimiter) {
+				buf.WriteByte(p.text[p.i])
+				p.i++
+			}
+			p.i += len(delimiter)
+			return buf.String(), nil
+		}
+		c := p.text[p.i]
+		if c != '\\' || delimiter == `'''` {
+			buf.WriteByte(c)
+			continue
+		}
+		// a backslash at the end of a line trims the blanks that follow
+		if rest := strings.TrimLeft(p.text[p.i+1:], " \t"); strings.HasPrefix(rest, "\n") {
+			p.i = len(p.text) - len(strings.TrimLeft(rest, " \t\n")) - 1
+			continue
+		}
+		if err := p.escape(&buf); err != nil {
+			return nil, err
+		}
+	}
+	return nil, p.errorf("unterminated string")
+}
+
+func (p *tomlParser) array() (interface{}, error) {
+	array := []interface{}{}
+	p.i++
+	for {
+		p.spaceAndLines()
+		if p.i < len(p.text) && p.text[p.i] == ']' {
+			p.i++
+			return array, nil
+		}
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+		p.spaceAndLines()
+		switch {
+		case p.i < len(p.text) && p.text[p.i] == ',':
+			p.i++
+		case p.i < len(p.text) && p.text[p.i] == ']':
+		default:
+			return nil, p.errorf("expected ',' or ']'")
+		}
+	}
+}
+
+func (p *tomlParser) inlineTable() (interface{}, error) {
+	object := orderedObject{}
+	p.i++
+	for {
+		p.space()
+		if p.i < len(p.text) && p.text[p.i] == '}' {
+			p.i++
+			return object, nil
+		}
+		keys, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) > 1 {
+			return nil, p.errorf("dotted keys aren't supported in inline tables")
+		}
+		if err := p.expect('='); err != nil {
+			return nil, err
+		}
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		object = append(object, orderedMember{key: keys[0], value: value})
+		p.space()
+		switch {
+		case p.i < len(p.text) && p.text[p.i] == ',':
+			p.i++
+		case p.i < len(p.text) && p.text[p.i] == '}':
+		default:
+			return nil, p.errorf("expected ',' or '}'")
+		}
+	}
+}
+
+func formatTOML(tree interface{}) ([]byte, error) {
+	object, ok := tree.(orderedObject)
+	if !ok {
+		return nil, newFormatError(0, "the configuration must be an object")
+	}
+	var buf bytes.Buffer
+	writeTOMLTable(&buf, nil, object, false)
+	return buf.Bytes(), nil
+}
+
+func isTOMLTable(value interface{}) bool {
+	object, ok := value.(orderedObject)
+	return ok && len(object) > 0
+}
+
+func isTOMLArrayOfTables(value interface{}) bool {
+	array, ok := value.([]interface{})
+	if !ok || len(array) == 0 {
+		return false
+	}
+	for _, e := range array {
+		if _, ok := e.(orderedObject); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// writes the values of a table and then its tables, whose headers can't
+// be followed by values of the parent. Comments of the first member were
+// written before the header of an array element.
+func writeTOMLTable(buf *bytes.Buffer, keys []string, object orderedObject, skip_first bool) {
+	for i, m := range object {
+		if m.value == nil || isTOMLTable(m.value) || isTOMLArrayOfTables(m.value) {
+			continue
+		}
+		if i > 0 || !skip_first {
+			writeComments(buf, m.comments, 0)
+		}
+		buf.WriteString(tomlKey(m.key) + " = " + tomlValue(m.value))
+		endLine(buf, m.inline)
+	}
+	for i, m := range object {
+		child := append(append([]string{}, keys...), m.key)
+		switch {
+		case isTOMLTable(m.value):
+			newSection(buf)
+			if i > 0 || !skip_first {
+				writeComments(buf, m.comments, 0)
+			}
+			buf.WriteString("[" + tomlKeyPath(child) + "]")
+			endLine(buf, m.inline)
+			writeTOMLTable(buf, child, m.value.(orderedObject), false)
+		case isTOMLArrayOfTables(m.value):
+			if i > 0 || !skip_first {
+				newSection(buf)
+				writeComments(buf, m.comments, 0)
+			}
+			for _, e := range m.value.([]interface{}) {
+				table := e.(orderedObject)
+				newSection(buf)
+				if len(table) > 0 {
+					writeComments(buf, table[0].comments, 0)
+				}
+				buf.WriteString("[[" + tomlKeyPath(child) + "]]\n")
+				writeTOMLTable(buf, child, table, true)
+			}
+		}
+	}
+}
+
+func newSection(buf *bytes.Buffer) {
+	if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n\n")) {
+		buf.WriteByte('\n')
+	}
+}
+
+func tomlKey(key string) string {
+	if key != "" && toml_bare_key.FindString(key) == key {
+		return key
+	}
+	return string(mustMarshal(key))
+}
+
+func tomlKeyPath(keys []string) string {
+	var quoted []string
+	for _, key := range keys {
+		quoted = append(quoted, tomlKey(key))
+	}
+	return strings.Join(quoted, ".")
+}
+
+func tomlValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		// multi-line strings read better as literals
+		if strings.Contains(v, "\n") && !strings.Contains(v, "'''") &&
+			!strings.HasSuffix(v, "'") && !strings.ContainsAny(v, "\r\x00") {
+			return "'''\n" + v + "'''"
+		}
+		return string(mustMarshal(v))
+	case []interface{}:
+		var items []string
+		for _, e := range v {
+			items = append(items, tomlValue(e))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case orderedObject:
+		var items []string
+		for _, m := range v {
+			if m.value != nil {
+				items = append(items, tomlKey(m.key)+" = "+tomlValue(m.value))
+			}
+		}
+		if len(items) == 0 {
+			return "{}"
+		}
+		return "{ " + strings.Join(items, ", ") + " }"
+	case nil:
+		return `""`
+	}
+	return string(mustMarshal(value))
+}
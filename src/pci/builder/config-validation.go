@@ -0,0 +1,563 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// names end up in the API routes, so they must match their regexps
+var valid_name = regexp.MustCompile("^[a-zA-Z0-9-_]+$")
+
+// configError locates a problem in a configuration file by its JSON path
+// and line
+type configError struct {
+	file    string
+	line    int
+	path    string
+	message string
+}
+
+func (e *configError) Error() string {
+	if e.file == "" && e.line == 0 {
+		return fmt.Sprintf("%s: %s", e.path, e.message)
+	}
+	location := e.file
+	if e.line > 0 {
+		location = fmt.Sprintf("%s:%d", e.file, e.line)
+	}
+	if e.path == "" {
+		return fmt.Sprintf("%s: %s", location, e.message)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, e.path, e.message)
+}
+
+type configValidator struct {
+	file   string
+	lines  map[string]int
+	errors []*configError
+}
+
+func (v *configValidator) add(path string, format string, args ...interface{}) {
+	v.errors = append(v.errors, &configError{file: v.file,
+		line:    v.lineOf(path),
+		path:    path,
+		message: fmt.Sprintf(format, args...)})
+}
+
+// the line of a path, or of its closest parent when it isn't in the file
+func (v *configValidator) lineOf(path string) int {
+	for {
+		if line, ok := v.lines[path]; ok {
+			return line
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			return 0
+		}
+		path = path[:i]
+	}
+}
+
+func (v *configValidator) sortedErrors() (errors []error) {
+	sort.SliceStable(v.errors, func(i, j int) bool {
+		return v.errors[i].line < v.errors[j].line
+	})
+	for _, e := range v.errors {
+		errors = append(errors, e)
+	}
+	return errors
+}
+
+// decodes a configuration strictly: unknown fields and values of the
+// wrong type are reported, then the builder is validated as a whole
+func decodeConfig(file string, content []byte) (object jsonobject, errors []error) {
+	v := &configValidator{file: file}
+	if v.decode(content, &object) {
+		v.validateBuilder(&object.Builder)
+	}
+	return object, v.sortedErrors()
+}
+
+// decodes the pipeline file of a build, whose stages don't need a state
+func decodePipeline(file string, content []byte) (pipeline PipelineBody, errors []error) {
+	v := &configValidator{file: file}
+	if v.decode(content, &pipeline) {
+		v.validateStages("Stages", "pipeline", pipeline.Stages, false)
+	}
+	return pipeline, v.sortedErrors()
+}
+
+// decodes content in the format of the file into object, reporting syntax
+// errors, unknown fields and wrong types. It returns whether object can
+// be validated.
+func (v *configValidator) decode(content []byte, object interface{}) bool {
+	file := v.file
+	if format := configFormat(file); format != format_json {
+		tree, lines, err := parseConfig(format, content)
+		if err != nil {
+			v.errors = append(v.errors, &configError{file: file,
+				line:    formatErrorLine(err),
+				message: err.Error()})
+			return false
+		}
+		var buf bytes.Buffer
+		if err := encodeOrdered(&buf, tree); err != nil {
+			v.add("", "%v", err)
+			return false
+		}
+		content = buf.Bytes()
+		v.lines = lines
+	}
+	var generic interface{}
+	if err := json.Unmarshal(content, &generic); err != nil {
+		if syntax, ok := err.(*json.SyntaxError); ok {
+			v.errors = append(v.errors, &configError{file: file,
+				line:    lineAt(content, syntax.Offset),
+				message: syntax.Error()})
+			return false
+		}
+		v.add("", "%v", err)
+		return false
+	}
+	if v.lines == nil {
+		v.lines = jsonLines(content)
+	}
+	v.checkFields("", generic, reflect.TypeOf(object).Elem())
+	if err := json.Unmarshal(content, object); err != nil {
+		// the wrong types are already reported with their paths
+		if len(v.errors) == 0 {
+			v.add("", "%v", err)
+		}
+		return false
+	}
+	return true
+}
+
+func lineAt(content []byte, offset int64) int {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	return bytes.Count(content[:offset], []byte("\n")) + 1
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func indexPath(path string, i int) string {
+	return fmt.Sprintf("%s[%d]", path, i)
+}
+
+// keys starting with "//" are comments
+func isCommentKey(key string) bool {
+	return strings.HasPrefix(key, "//")
+}
+
+// maps the JSON path of every key and array element to its line
+func jsonLines(content []byte) map[string]int {
+	lines := make(map[string]int)
+	dec := json.NewDecoder(bytes.NewReader(content))
+	var value func(path string) error
+	value = func(path string) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if _, ok := lines[path]; !ok {
+			lines[path] = lineAt(content, dec.InputOffset())
+		}
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				child := joinPath(path, key.(string))
+				lines[child] = lineAt(content, dec.InputOffset())
+				if err := value(child); err != nil {
+					return err
+				}
+			}
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := value(indexPath(path, i)); err != nil {
+					return err
+				}
+			}
+		default:
+			return nil
+		}
+		_, err = dec.Token()
+		return err
+	}
+	value("")
+	return lines
+}
+
+var command_args_type = reflect.TypeOf(commandArgs(nil))
+
+// compares a decoded JSON value with the type it will be stored in
+func (v *configValidator) checkFields(path string, value interface{}, t reflect.Type) {
+	if value == nil {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			v.add(path, "must be an object")
+			return
+		}
+		for _, key := range sortedKeys(object) {
+			if isCommentKey(key) {
+				continue
+			}
+			field, ok := jsonField(t, key)
+			if !ok {
+				v.add(joinPath(path, key), "unknown field %s", key)
+				continue
+			}
+			v.checkFields(joinPath(path, key), object[key], field.Type)
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			v.add(path, "must be an object")
+			return
+		}
+		for _, key := range sortedKeys(object) {
+			v.checkFields(joinPath(path, key), object[key], t.Elem())
+		}
+	case reflect.Ptr:
+		v.checkFields(path, value, t.Elem())
+	case reflect.Slice:
+		if _, ok := value.(string); ok && t == command_args_type {
+			return
+		}
+		array, ok := value.([]interface{})
+		if !ok {
+			v.add(path, "must be an array")
+			return
+		}
+		for i, elem := range array {
+			v.checkFields(indexPath(path, i), elem, t.Elem())
+		}
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			v.add(path, "must be a string")
+		}
+	case reflect.Int:
+		if n, ok := value.(float64); !ok || n != float64(int(n)) {
+			v.add(path, "must be an integer")
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			v.add(path, "must be true or false")
+		}
+	}
+}
+
+// the exported field a key decodes into: like encoding/json, by its tag
+// name or its own, an exact match first and else ignoring case
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	var folded *reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.PkgPath != "" || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if name == key {
+			return field, true
+		}
+		if folded == nil && strings.EqualFold(name, key) {
+			folded = &field
+		}
+	}
+	if folded == nil {
+		return reflect.StructField{}, false
+	}
+	return *folded, true
+}
+
+func sortedKeys(object map[string]interface{}) (keys []string) {
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *configValidator) checkName(path string, kind string, name string, seen map[string]bool) {
+	switch {
+	case name == "":
+		v.add(path, "%s has no name", kind)
+		return
+	case !valid_name.MatchString(name):
+		v.add(path, "%s name '%s' may only have letters, digits, '-' and '_'", kind, name)
+	case seen[name]:
+		v.add(path, "duplicate %s name '%s'", kind, name)
+	}
+	seen[name] = true
+}
+
+func (v *configValidator) checkState(path string, state string) {
+	if !isStateName(state) {
+		v.add(path, "invalid state '%s'", state)
+	}
+}
+
+func (v *configValidator) checkTimeout(path string, timeout string) {
+	if _, err := str2duration(timeout); err != nil {
+		v.add(path, "invalid timeout '%s'", timeout)
+	}
+}
+
+func (v *configValidator) checkDirectory(path string, directory string) {
+	if directory == "" {
+		v.add(path, "directory is missing")
+		return
+	}
+	if info, err := os.Stat(directory); err != nil || !info.IsDir() {
+		v.add(path, "directory '%s' doesn't exist", directory)
+	}
+}
+
+func (v *configValidator) validateBuilder(body *BuilderBody) {
+	path := "Builder"
+	v.checkName(joinPath(path, "Name"), "builder", body.Name, map[string]bool{})
+	if body.MaxParallelBuilds < 0 {
+		v.add(joinPath(path, "MaxParallelBuilds"), "must not be negative")
+	}
+	if body.LogTail < 0 {
+		v.add(joinPath(path, "LogTail"), "must not be negative")
+	}
+	v.checkCoalesce(joinPath(path, "Coalesce"), body.Coalesce)
+	tokens := make(map[string]bool)
+	v.validateTokens(joinPath(path, "Tokens"), body.Tokens, tokens)
+	if body.TokensFile != "" {
+		_, errors := readTokensFile(configPath(body.TokensFile), tokens)
+		for _, err := range errors {
+			v.add(joinPath(path, "TokensFile"), "%v", err)
+		}
+	}
+	if body.Listen != nil {
+		v.validateListen(joinPath(path, "Listen"), body.Listen)
+	}
+	builds := make(map[string]bool)
+	for i := range body.Builds {
+		build_path := indexPath(joinPath(path, "Builds"), i)
+		v.checkName(joinPath(build_path, "Name"), "build", body.Builds[i].Name, builds)
+		v.validateBuild(build_path, &body.Builds[i])
+	}
+}
+
+func (v *configValidator) validateBuild(path string, body *BuildBody) {
+	switch {
+	case body.Source == nil:
+		v.checkDirectory(joinPath(path, "Directory"), body.Directory)
+	case body.Directory == "":
+		// the first checkout creates it
+		v.add(joinPath(path, "Directory"), "directory is missing")
+	}
+	v.checkState(joinPath(path, "State"), body.State)
+	v.checkTimeout(joinPath(path, "Timeout"), body.Timeout)
+	if body.Source != nil {
+		v.validateSource(joinPath(path, "Source"), body.Source)
+	}
+	if body.Webhook != nil {
+		v.validateWebhook(joinPath(path, "Webhook"), body.Webhook)
+	}
+	v.checkSchedule(path, body)
+	v.checkCoalesce(joinPath(path, "Coalesce"), body.Coalesce)
+	v.validateParameters(joinPath(path, "Parameters"), body.Parameters)
+	if body.PipelineFile != "" {
+		// the stages are read from the project when the build runs
+		if len(body.Stages) > 0 {
+			v.add(joinPath(path, "Stages"), "build %s has both Stages and a PipelineFile", body.Name)
+		}
+		return
+	}
+	v.validateStages(joinPath(path, "Stages"), "build "+body.Name, body.Stages, true)
+}
+
+var valid_branch = regexp.MustCompile("^[A-Za-z0-9._/-]+$")
+
+func (v *configValidator) validateSource(path string, body *SourceBody) {
+	switch {
+	case body.Repository == "":
+		v.add(joinPath(path, "Repository"), "repository is missing")
+	case strings.HasPrefix(body.Repository, "-"):
+		v.add(joinPath(path, "Repository"), "invalid repository '%s'", body.Repository)
+	}
+	if body.Branch != "" && (!valid_branch.MatchString(body.Branch) ||
+		strings.HasPrefix(body.Branch, "-") || strings.Contains(body.Branch, "..")) {
+		v.add(joinPath(path, "Branch"), "invalid branch '%s'", body.Branch)
+	}
+	if body.PollInterval != "" {
+		if d, err := time.ParseDuration(body.PollInterval); err != nil || d < time.Second {
+			v.add(joinPath(path, "PollInterval"), "invalid poll interval '%s', at least 1s", body.PollInterval)
+		}
+	}
+}
+
+func (v *configValidator) validateParameters(path string, parameters []ParameterBody) {
+	names := make(map[string]bool)
+	for i := range parameters {
+		parameter := &parameters[i]
+		parameter_path := indexPath(path, i)
+		switch {
+		case !valid_parameter.MatchString(parameter.Name):
+			v.add(joinPath(parameter_path, "Name"), "invalid parameter name '%s'", parameter.Name)
+		case strings.HasPrefix(parameter.Name, "PCI_"):
+			v.add(joinPath(parameter_path, "Name"), "parameter %s would hide a PCI_ variable", parameter.Name)
+		case names[parameter.Name]:
+			v.add(joinPath(parameter_path, "Name"), "duplicate parameter %s", parameter.Name)
+		}
+		names[parameter.Name] = true
+		switch parameter.Type {
+		case "", parameter_string, parameter_int, parameter_bool:
+		default:
+			v.add(joinPath(parameter_path, "Type"), "invalid parameter type '%s', expected %s, %s or %s",
+				parameter.Type, parameter_string, parameter_int, parameter_bool)
+			continue
+		}
+		for j, value := range parameter.AllowedValues {
+			allowed := ParameterBody{Name: parameter.Name, Type: parameter.Type}
+			if err := allowed.check(value); err != nil {
+				v.add(indexPath(joinPath(parameter_path, "AllowedValues"), j), "%v", err)
+			}
+		}
+		if err := parameter.check(parameter.defaultValue()); err != nil {
+			v.add(joinPath(parameter_path, "Default"), "%v", err)
+		}
+	}
+}
+
+func (v *configValidator) checkCoalesce(path string, coalesce string) {
+	switch coalesce {
+	case "", coalesce_none, coalesce_identical, coalesce_build:
+	default:
+		v.add(path, "invalid coalescing '%s', expected %s, %s or %s",
+			coalesce, coalesce_none, coalesce_identical, coalesce_build)
+	}
+}
+
+func (v *configValidator) checkSchedule(path string, body *BuildBody) {
+	if body.Schedule == "" {
+		if body.TimeZone != "" {
+			v.add(joinPath(path, "TimeZone"), "time zone without a schedule")
+		}
+		if body.Jitter != "" {
+			v.add(joinPath(path, "Jitter"), "jitter without a schedule")
+		}
+		return
+	}
+	if _, err := newCronSchedule(body.Schedule, body.TimeZone, body.Jitter); err != nil {
+		v.add(joinPath(path, "Schedule"), "%v", err)
+	}
+}
+
+func (v *configValidator) validateWebhook(path string, body *WebhookBody) {
+	if body.Secret == "" {
+		v.add(joinPath(path, "Secret"), "secret is missing")
+	}
+	if body.Branch != "" && !validRef(body.Branch) {
+		v.add(joinPath(path, "Branch"), "invalid branch '%s'", body.Branch)
+	}
+}
+
+func (v *configValidator) validateStages(path string, owner string, stages []StageBody, need_state bool) {
+	if len(stages) == 0 {
+		v.add(path, "%s has no stages", owner)
+	}
+	names := make(map[string]bool)
+	for i := range stages {
+		stage_path := indexPath(path, i)
+		v.checkName(joinPath(stage_path, "Name"), "stage", stages[i].Name, names)
+		v.validateStage(stage_path, &stages[i], need_state)
+	}
+	unknown := false
+	for i, stage := range stages {
+		for j, name := range stage.DependsOn {
+			if !names[name] {
+				v.add(indexPath(joinPath(indexPath(path, i), "DependsOn"), j),
+					"unknown stage '%s'", name)
+				unknown = true
+			}
+		}
+	}
+	if unknown {
+		return
+	}
+	build := NewBuild(owner, "", 0, State_queued, 0, nil)
+	for _, stage := range stages {
+		build.AddStage(NewStage(stage.Name, stage.Priority, State_queued, 0, nil, stage.DependsOn))
+	}
+	if err := build.CheckDependencies(); err != nil {
+		v.add(path, "%v", err)
+	}
+}
+
+func (v *configValidator) validateStage(path string, body *StageBody, need_state bool) {
+	if need_state || body.State != "" {
+		v.checkState(joinPath(path, "State"), body.State)
+	}
+	v.checkTimeout(joinPath(path, "Timeout"), body.Timeout)
+	if len(body.Commands) == 0 {
+		v.add(path, "stage %s has no commands", body.Name)
+	}
+	commands := make(map[string]bool)
+	for i, command := range body.Commands {
+		command_path := indexPath(joinPath(path, "Commands"), i)
+		v.checkName(joinPath(command_path, "Name"), "command", command.Name, commands)
+		if command.Command == "" {
+			v.add(joinPath(command_path, "Command"), "command %s has nothing to run", command.Name)
+		}
+		// a directory naming parameters only exists once they have values
+		if command.Directory != "" && !parameter_reference.MatchString(command.Directory) {
+			v.checkDirectory(joinPath(command_path, "Directory"), command.Directory)
+		}
+		v.checkTimeout(joinPath(command_path, "Timeout"), command.Timeout)
+	}
+}
@@ -0,0 +1,703 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The subset of YAML configurations are written in: block mappings and
+// sequences, flow collections on a single line, plain and quoted scalars,
+// literal and folded blocks, and comments. Anchors, aliases, tags and
+// multiple documents are not supported, and integers with leading zeros
+// are read as strings.
+
+type yamlLine struct {
+	number   int
+	indent   int
+	text     string
+	inline   string
+	comments []string
+}
+
+type yamlParser struct {
+	raw     []string
+	pos     int
+	current *yamlLine
+	lines   map[string]int
+}
+
+func parseYAML(content []byte) (interface{}, map[string]int, error) {
+	text := strings.Replace(string(content), "\r\n", "\n", -1)
+	p := &yamlParser{raw: strings.Split(text, "\n"), lines: make(map[string]int)}
+	line, err := p.peek()
+	if err != nil {
+		return nil, nil, err
+	}
+	if line == nil {
+		return orderedObject{}, p.lines, nil
+	}
+	p.lines[""] = line.number
+	value, err := p.parseBlock(line.indent, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	if line, err := p.peek(); err != nil {
+		return nil, nil, err
+	} else if line != nil {
+		return nil, nil, newFormatError(line.number, "unexpected '%s'", line.text)
+	}
+	return value, p.lines, nil
+}
+
+// the next line with content, along with the comments before it
+func (p *yamlParser) peek() (*yamlLine, error) {
+	if p.current != nil {
+		return p.current, nil
+	}
+	var comments []string
+	for ; p.pos < len(p.raw); p.pos++ {
+		raw := strings.TrimRight(p.raw[p.pos], " \t")
+		trimmed := strings.TrimLeft(raw, " ")
+		switch {
+		case trimmed == "" || trimmed == "---" || trimmed == "...":
+			continue
+		case strings.HasPrefix(trimmed, "\t"):
+			return nil, newFormatError(p.pos+1, "tabs can't be used for indentation")
+		case strings.HasPrefix(trimmed, "#"):
+			comments = append(comments, trimmed)
+			continue
+		}
+		text, inline := stripYAMLComment(trimmed)
+		p.current = &yamlLine{number: p.pos + 1,
+			indent:   len(raw) - len(trimmed),
+			text:     text,
+			inline:   inline,
+			comments: comments}
+		return p.current, nil
+	}
+	return nil, nil
+}
+
+func (p *yamlParser) next() {
+	p.current = nil
+	p.pos++
+}
+
+// splits a trailing comment, which starts with a '#' after a blank outside
+// of quotes
+func stripYAMLComment(text string) (string, string) {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && startsYAMLScalar(text[:i]):
+			quote = c
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return strings.TrimRight(text[:i], " \t"), text[i:]
+		}
+	}
+	return text, ""
+}
+
+// whether a scalar may start after prefix, so a quote there opens a string
+func startsYAMLScalar(prefix string) bool {
+	prefix = strings.TrimRight(prefix, " ")
+	return prefix == "" || strings.ContainsAny(prefix[len(prefix)-1:], ":-[{,")
+}
+
+func isYAMLSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splits 'key: rest', the key may be quoted
+func splitYAMLKey(text string) (string, string, bool) {
+	if text == "" || strings.ContainsAny(text[:1], "[{#&*!|>%@`") {
+		return "", "", false
+	}
+	if text[0] == '"' || text[0] == '\'' {
+		key, n, err := parseYAMLQuoted(text, 0)
+		if err != nil || !isYAMLKeyEnd(text, n) {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(text[n+1:]), true
+	}
+	for i := 0; i < len(text); i++ {
+		if isYAMLKeyEnd(text, i) {
+			key := strings.TrimSpace(text[:i])
+			if key == "" {
+				return "", "", false
+			}
+			return key, strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+func isYAMLKeyEnd(text string, i int) bool {
+	return i < len(text) && text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ')
+}
+
+func (p *yamlParser) parseBlock(indent int, path string) (interface{}, error) {
+	line, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if isYAMLSequenceItem(line.text) {
+		return p.parseSequence(indent, path)
+	}
+	if _, _, ok := splitYAMLKey(line.text); ok {
+		return p.parseMapping(indent, path)
+	}
+	p.next()
+	return parseYAMLFlow(line.text, line.number)
+}
+
+func (p *yamlParser) parseMapping(indent int, path string) (interface{}, error) {
+	object := orderedObject{}
+	for {
+		line, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if line == nil || line.indent < indent {
+			return object, nil
+		}
+		if line.indent > indent {
+			return nil, newFormatError(line.number, "bad indentation")
+		}
+		if isYAMLSequenceItem(line.text) {
+			// a sequence at the indentation of the key it belongs to
+			return object, nil
+		}
+		key, rest, ok := splitYAMLKey(line.text)
+		if err := unsupportedYAML(line.text, line.number); err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, newFormatError(line.number, "expected 'key: value', found '%s'", line.text)
+		}
+		if _, ok := object.get(key); ok {
+			return nil, newFormatError(line.number, "duplicate key %s", key)
+		}
+		child := joinPath(path, key)
+		p.lines[child] = line.number
+		member := orderedMember{key: key, comments: line.comments, inline: line.inline}
+		p.next()
+		if member.value, err = p.parseValue(rest, indent, child, line.number); err != nil {
+			return nil, err
+		}
+		object = append(object, member)
+	}
+}
+
+// the value of a key, either on its line or in the block below it
+func (p *yamlParser) parseValue(rest string, indent int, path string, number int) (interface{}, error) {
+	switch {
+	case rest == "":
+		next, err := p.peek()
+		if err != nil || next == nil {
+			return nil, err
+		}
+		if next.indent > indent || (next.indent == indent && isYAMLSequenceItem(next.text)) {
+			return p.parseBlock(next.indent, path)
+		}
+		return nil, nil
+	case rest[0] == '|' || rest[0] == '>':
+		return p.parseBlockScalar(rest, indent, number)
+	}
+	if _, _, ok := splitYAMLKey(rest); ok {
+		return nil, newFormatError(number, "a mapping can't start on the line of its key, found '%s'", rest)
+	}
+	return parseYAMLFlow(rest, number)
+}
+
+func (p *yamlParser) parseSequence(indent int, path string) (interface{}, error) {
+	array := []interface{}{}
+	for {
+		line, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if line == nil || line.indent < indent || !isYAMLSequenceItem(line.text) {
+			return array, nil
+		}
+		if line.indent > indent {
+			return nil, newFormatError(line.number, "bad indentation")
+		}
+		child := indexPath(path, len(array))
+		p.lines[child] = line.number
+		rest := strings.TrimLeft(line.text[1:], " ")
+		var value interface{}
+		_, _, is_key := splitYAMLKey(rest)
+		switch {
+		case rest == "":
+			p.next()
+			value, err = p.parseValue("", indent, child, line.number)
+		case is_key || isYAMLSequenceItem(rest):
+			// a collection starting on the line of its dash
+			line.indent += len(line.text) - len(rest)
+			line.text = rest
+			value, err = p.parseBlock(line.indent, child)
+		default:
+			p.next()
+			value, err = p.parseValue(rest, indent, child, line.number)
+		}
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+	}
+}
+
+// reads a literal (|) or folded (>) block following its header line
+func (p *yamlParser) parseBlockScalar(header string, indent int, number int) (interface{}, error) {
+	style, chomp := header[0], header[1:]
+	if chomp != "" && chomp != "-" && chomp != "+" {
+		return nil, newFormatError(number, "unsupported block header '%s'", header)
+	}
+	var lines []string
+	block_indent := -1
+	for ; p.pos < len(p.raw); p.pos++ {
+		raw := p.raw[p.pos]
+		trimmed := strings.TrimLeft(raw, " ")
+		if strings.TrimSpace(raw) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		n := len(raw) - len(trimmed)
+		if block_indent < 0 {
+			if n <= indent {
+				break
+			}
+			block_indent = n
+		}
+		if n < block_indent {
+			break
+		}
+		lines = append(lines, raw[block_indent:])
+	}
+	trailing := 0
+	for trailing < len(lines) && lines[len(lines)-1-trailing] == "" {
+		trailing++
+	}
+	lines = lines[:len(lines)-trailing]
+	var text string
+	if style == '|' {
+		text = strings.Join(lines, "\n")
+	} else {
+		for i, line := range lines {
+			switch {
+			case i == 0:
+			case line == "" || lines[i-1] == "":
+				text += "\n"
+			default:
+				text += " "
+			}
+			text += line
+		}
+	}
+	switch {
+	case text == "" || chomp == "-":
+	case chomp == "+":
+		text += strings.Repeat("\n", trailing+1)
+	default:
+		text += "\n"
+	}
+	return text, nil
+}
+
+type yamlFlow struct {
+	text   string
+	i      int
+	number int
+}
+
+// the error for a value starting with a feature the reader doesn't have
+func unsupportedYAML(text string, number int) error {
+	if text == "" {
+		return nil
+	}
+	switch text[0] {
+	case '&':
+		return newFormatError(number, "anchors are not supported, found '%s'", text)
+	case '*':
+		return newFormatError(number, "aliases are not supported, found '%s'", text)
+	case '!':
+		return newFormatError(number, "tags are not supported, found '%s'", text)
+	}
+	return nil
+}
+
+// parses a scalar or a flow collection taking a whole value
+func parseYAMLFlow(text string, number int) (interface{}, error) {
+	if err := unsupportedYAML(text, number); err != nil {
+		return nil, err
+	}
+	if text == "" || !strings.ContainsAny(text[:1], "[{\"'") {
+		return resolveYAMLScalar(text), nil
+	}
+	f := &yamlFlow{text: text, number: number}
+	value, err := f.value()
+	if err != nil {
+		return nil, err
+	}
+	f.space()
+	if f.i < len(f.text) {
+		return nil, newFormatError(number, "unexpected '%s'", f.text[f.i:])
+	}
+	return value, nil
+}
+
+func (f *yamlFlow) space() {
+	for f.i < len(f.text) && f.text[f.i] == ' ' {
+		f.i++
+	}
+}
+
+func (f *yamlFlow) value() (interface{}, error) {
+	f.space()
+	if f.i == len(f.text) {
+		return nil, newFormatError(f.number, "missing value")
+	}
+	switch f.text[f.i] {
+	case '[':
+		return f.sequence()
+	case '{':
+		return f.mapping()
+	case '"', '\'':
+		str, n, err := parseYAMLQuoted(f.text, f.i)
+		if err != nil {
+			return nil, newFormatError(f.number, "%v", err)
+		}
+		f.i = n
+		return str, nil
+	}
+	start := f.i
+	for f.i < len(f.text) && !strings.ContainsAny(f.text[f.i:f.i+1], ",]}") &&
+		!isYAMLKeyEnd(f.text, f.i) {
+		f.i++
+	}
+	scalar := strings.TrimSpace(f.text[start:f.i])
+	if err := unsupportedYAML(scalar, f.number); err != nil {
+		return nil, err
+	}
+	return resolveYAMLScalar(scalar), nil
+}
+
+func (f *yamlFlow) sequence() (interface{}, error) {
+	array := []interface{}{}
+	f.i++
+	for {
+		f.space()
+		if f.i < len(f.text) && f.text[f.i] == ']' {
+			f.i++
+			return array, nil
+		}
+		value, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+		if err := f.separator(']'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (f *yamlFlow) mapping() (interface{}, error) {
+	object := orderedObject{}
+	f.i++
+	for {
+		f.space()
+		if f.i < len(f.text) && f.text[f.i] == '}' {
+			f.i++
+			return object, nil
+		}
+		key, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		f.space()
+		if f.i == len(f.text) || f.text[f.i] != ':' {
+			return nil, newFormatError(f.number, "expected ':' in a flow mapping")
+		}
+		f.i++
+		value, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		object = append(object, orderedMember{key: scalarString(key), value: value})
+		if err := f.separator('}'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// consumes a ',' or leaves the closing character for the caller
+func (f *yamlFlow) separator(end byte) error {
+	f.space()
+	switch {
+	case f.i < len(f.text) && f.text[f.i] == ',':
+		f.i++
+		return nil
+	case f.i < len(f.text) && f.text[f.i] == end:
+		return nil
+	}
+	return newFormatError(f.number, "expected ',' or '%c'", end)
+}
+
+func scalarString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	}
+	return strings.TrimSpace(string(mustMarshal(value)))
+}
+
+// parses the quoted scalar at text[start], returning where it ends
+func parseYAMLQuoted(text string, start int) (string, int, error) {
+	quote := text[start]
+	for i := start + 1; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case quote == '\'' && text[i] == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case text[i] == quote:
+			body := text[start+1 : i]
+			if quote == '\'' {
+				return strings.Replace(body, "''", "'", -1), i + 1, nil
+			}
+			str, err := strconv.Unquote("\"" + body + "\"")
+			if err != nil {
+				return "", 0, newFormatError(0, "invalid escape in %s", text[start:i+1])
+			}
+			return str, i + 1, nil
+		}
+	}
+	return "", 0, newFormatError(0, "unterminated string %s", text[start:])
+}
+
+// 0660 is neither decimal nor octal, it stays a string
+var yaml_int = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)$`)
+var yaml_float = regexp.MustCompile(`^[-+]?([0-9]+\.[0-9]*|\.[0-9]+)([eE][-+]?[0-9]+)?$`)
+
+// plain scalars that look like null, booleans or numbers are not strings
+func resolveYAMLScalar(text string) interface{} {
+	switch text {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if yaml_int.MatchString(text) {
+		if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return json.Number(strconv.FormatInt(n, 10))
+		}
+	}
+	if yaml_float.MatchString(text) {
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+		}
+	}
+	return text
+}
+
+func formatYAML(tree interface{}) ([]byte, error) {
+	object, ok := tree.(orderedObject)
+	if !ok {
+		return nil, newFormatError(0, "the configuration must be an object")
+	}
+	var buf bytes.Buffer
+	writeYAMLObject(&buf, object, 0, "")
+	return buf.Bytes(), nil
+}
+
+func writeComments(buf *bytes.Buffer, comments []string, indent int) {
+	for _, comment := range comments {
+		buf.WriteString(strings.Repeat(" ", indent) + comment + "\n")
+	}
+}
+
+func endLine(buf *bytes.Buffer, inline string) {
+	if inline != "" {
+		buf.WriteString(" " + inline)
+	}
+	buf.WriteByte('\n')
+}
+
+// the first member goes after first_prefix, the dash of a sequence item,
+// whose comments were already written
+func writeYAMLObject(buf *bytes.Buffer, object orderedObject, indent int, first_prefix string) {
+	for i, m := range object {
+		prefix := strings.Repeat(" ", indent)
+		if i == 0 && first_prefix != "" {
+			prefix = first_prefix
+		} else {
+			writeComments(buf, m.comments, indent)
+		}
+		buf.WriteString(prefix + yamlScalar(m.key) + ":")
+		writeYAMLValue(buf, m.value, indent, m.inline)
+	}
+}
+
+func writeYAMLValue(buf *bytes.Buffer, value interface{}, indent int, inline string) {
+	switch v := value.(type) {
+	case orderedObject:
+		if len(v) == 0 {
+			buf.WriteString(" {}")
+			endLine(buf, inline)
+			return
+		}
+		endLine(buf, inline)
+		writeYAMLObject(buf, v, indent+2, "")
+	case []interface{}:
+		if isFlat(v) {
+			buf.WriteString(" " + yamlFlowSequence(v))
+			endLine(buf, inline)
+			return
+		}
+		endLine(buf, inline)
+		writeYAMLSequence(buf, v, indent+2)
+	case string:
+		if !isYAMLBlock(v) {
+			buf.WriteString(" " + yamlScalar(v))
+			endLine(buf, inline)
+			return
+		}
+		header := " |-"
+		if strings.HasSuffix(v, "\n") {
+			header = " |"
+		}
+		buf.WriteString(header)
+		endLine(buf, inline)
+		for _, line := range strings.Split(strings.TrimSuffix(v, "\n"), "\n") {
+			if line != "" {
+				buf.WriteString(strings.Repeat(" ", indent+2) + line)
+			}
+			buf.WriteByte('\n')
+		}
+	default:
+		buf.WriteString(" " + yamlScalar(v))
+		endLine(buf, inline)
+	}
+}
+
+func writeYAMLSequence(buf *bytes.Buffer, array []interface{}, indent int) {
+	dash := strings.Repeat(" ", indent) + "- "
+	for _, e := range array {
+		switch v := e.(type) {
+		case orderedObject:
+			if len(v) == 0 {
+				buf.WriteString(dash + "{}\n")
+				continue
+			}
+			writeComments(buf, v[0].comments, indent)
+			writeYAMLObject(buf, v, indent+2, dash)
+		case []interface{}:
+			buf.WriteString(dash + yamlFlowSequence(v) + "\n")
+		default:
+			buf.WriteString(dash + yamlScalar(v) + "\n")
+		}
+	}
+}
+
+// whether an array only holds scalars, so it fits on one line
+func isFlat(array []interface{}) bool {
+	for _, e := range array {
+		switch e.(type) {
+		case orderedObject, []interface{}:
+			return false
+		}
+	}
+	return true
+}
+
+func yamlFlowSequence(array []interface{}) string {
+	if !isFlat(array) {
+		// JSON is valid flow YAML
+		var buf bytes.Buffer
+		encodeOrdered(&buf, array)
+		return buf.String()
+	}
+	var items []string
+	for _, e := range array {
+		items = append(items, yamlScalar(e))
+	}
+	return "[" + strings.Join(items, ", ") + "]"
+}
+
+// multi-line strings are written as literal blocks when they read back
+// the same
+func isYAMLBlock(str string) bool {
+	return strings.Contains(str, "\n") && !strings.HasPrefix(str, " ") &&
+		!strings.HasPrefix(str, "\n") && !strings.HasSuffix(str, "\n\n") &&
+		!strings.ContainsAny(str, "\r\t")
+}
+
+var yaml_plain = regexp.MustCompile(`^[A-Za-z0-9_./$=+()-]([A-Za-z0-9_ ./$=+()@-]*[A-Za-z0-9_./$=+()@-])?$`)
+
+func yamlScalar(value interface{}) string {
+	str, ok := value.(string)
+	if !ok {
+		if value == nil {
+			return "null"
+		}
+		return string(mustMarshal(value))
+	}
+	if yaml_plain.MatchString(str) && !strings.HasPrefix(str, "- ") &&
+		resolveYAMLScalar(str) == str {
+		return str
+	}
+	return string(mustMarshal(str))
+}
+
+// JSON without HTML escaping, whose strings are valid in YAML and TOML
+func mustMarshal(value interface{}) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(value); err != nil {
+		panic(err)
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n")
+}
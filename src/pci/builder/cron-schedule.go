@@ -0,0 +1,262 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the range of a cron field and the names it accepts
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names []string
+}
+
+var cron_fields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12,
+		names: []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	// 7 is sunday too
+	{name: "day of week", min: 0, max: 7,
+		names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+var cron_macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// how far ahead a schedule is looked at before giving up, e.g. for the
+// 30th of February
+const cron_search_years = 5
+
+// cronSchedule is a parsed 5-field cron expression, in a time zone and
+// with a random delay of up to jitter added to every fire time
+type cronSchedule struct {
+	spec        string
+	time_zone   string
+	jitter_spec string
+	jitter      time.Duration
+	location    *time.Location
+	// the values every field matches, indexed by value
+	minutes  [60]bool
+	hours    [24]bool
+	days     [32]bool
+	months   [13]bool
+	weekdays [7]bool
+	// whether the days of month and week start with '*' (or '?'), as in
+	// Vixie cron, even when stepped like '*/2'
+	any_day     bool
+	any_weekday bool
+}
+
+func newCronSchedule(spec string, time_zone string, jitter string) (*cronSchedule, error) {
+	s := &cronSchedule{spec: spec, time_zone: time_zone, jitter_spec: jitter, location: time.Local}
+	if time_zone != "" {
+		location, err := time.LoadLocation(time_zone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown time zone '%s'", time_zone)
+		}
+		s.location = location
+	}
+	if jitter != "" {
+		d, err := time.ParseDuration(jitter)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid jitter '%s'", jitter)
+		}
+		s.jitter = d
+	}
+	expression := strings.TrimSpace(spec)
+	if macro, ok := cron_macros[strings.ToLower(expression)]; ok {
+		expression = macro
+	}
+	fields := strings.Fields(expression)
+	if len(fields) != len(cron_fields) {
+		return nil, fmt.Errorf("invalid schedule '%s', expected 5 fields", spec)
+	}
+	var values [5][]bool
+	for i, field := range fields {
+		matched, err := parseCronField(field, cron_fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule '%s': %v", spec, err)
+		}
+		values[i] = matched
+	}
+	copy(s.minutes[:], values[0])
+	copy(s.hours[:], values[1])
+	copy(s.days[:], values[2])
+	copy(s.months[:], values[3])
+	copy(s.weekdays[:], values[4])
+	if values[4][7] {
+		s.weekdays[0] = true
+	}
+	s.any_day = strings.HasPrefix(fields[2], "*") || strings.HasPrefix(fields[2], "?")
+	s.any_weekday = strings.HasPrefix(fields[4], "*") || strings.HasPrefix(fields[4], "?")
+	if s.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule '%s' never fires", spec)
+	}
+	return s, nil
+}
+
+// parses a list of values, ranges and steps into the values it matches
+func parseCronField(field string, f cronField) ([]bool, error) {
+	matched := make([]bool, f.max+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step in %s '%s'", f.name, part)
+			}
+			step = n
+			part = part[:i]
+		}
+		low, high := f.min, f.max
+		switch {
+		case part == "*" || part == "?":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = cronValue(bounds[0], f); err != nil {
+				return nil, err
+			}
+			if high, err = cronValue(bounds[1], f); err != nil {
+				return nil, err
+			}
+			if low > high {
+				return nil, fmt.Errorf("invalid range in %s '%s'", f.name, part)
+			}
+		default:
+			var err error
+			if low, err = cronValue(part, f); err != nil {
+				return nil, err
+			}
+			// 'a/n' runs from a to the end of the range
+			if step == 1 {
+				high = low
+			}
+		}
+		for v := low; v <= high; v += step {
+			matched[v] = true
+		}
+	}
+	return matched, nil
+}
+
+func cronValue(value string, f cronField) (int, error) {
+	for i, name := range f.names {
+		if name != "" && strings.EqualFold(value, name) {
+			return i, nil
+		}
+	}
+	v, err := strconv.Atoi(value)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s '%s'", f.name, value)
+	}
+	return v, nil
+}
+
+// like cron, a day matches either field when neither starts with '*', and
+// both otherwise
+func (s *cronSchedule) matchDay(t time.Time) bool {
+	day, weekday := s.days[t.Day()], s.weekdays[t.Weekday()]
+	if s.any_day || s.any_weekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// the first time the schedule matches after t, zero if there is none
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.In(s.location)
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, s.location).Add(time.Minute)
+	limit := t.Year() + cron_search_years
+	for t.Year() <= limit {
+		var skip time.Time
+		switch {
+		case !s.months[t.Month()]:
+			skip = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.location)
+		case !s.matchDay(t):
+			skip = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.location)
+		case !s.hours[t.Hour()]:
+			skip = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.location)
+		case !s.minutes[t.Minute()]:
+			skip = t.Add(time.Minute)
+		default:
+			return t
+		}
+		// daylight saving changes may move a wall clock time backwards
+		if !skip.After(t) {
+			skip = t.Add(time.Hour)
+		}
+		t = skip
+	}
+	return time.Time{}
+}
+
+// the next fire time after t, with its jitter
+func (s *cronSchedule) nextFire(t time.Time) time.Time {
+	next := s.next(t)
+	if next.IsZero() || s.jitter == 0 {
+		return next
+	}
+	return next.Add(time.Duration(rand.Int63n(int64(s.jitter))))
+}
+
+// requests runs of the builds whose schedule is due and wakes the main loop
+func (b *Builder) RunSchedules() {
+	for range time.Tick(time.Second) {
+		now := time.Now()
+		queued := false
+		b.mutex.Lock()
+		for _, build := range b.builds {
+			if build.schedule == nil || build.schedule_next.IsZero() || now.Before(build.schedule_next) {
+				continue
+			}
+			build.schedule_next = build.schedule.nextFire(now)
+			b.enqueue(build, newBuildRequest(build, "schedule", ""))
+			queued = true
+		}
+		b.mutex.Unlock()
+		if queued {
+			b.trigger()
+		}
+	}
+}
@@ -0,0 +1,363 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// The PCI dashboard. It only uses the /v2 API, with the token given in the
+// page, and fetches nothing from elsewhere.
+
+'use strict';
+
+// the API the page is served with, whatever prefix it is behind
+const api_base = location.pathname.replace(/(\/v2)?\/dashboard\/.*$/, '') + '/v2';
+const poll_interval = 3000;
+const token_key = 'pci-token';
+
+let builder = null;
+let selected_build = null;
+let selected_stage = null;
+// aborts the log being followed
+let log_controller = null;
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+// builds an element; strings become text, never markup
+function el(tag, props, ...children) {
+  const node = document.createElement(tag);
+  Object.assign(node, props || {});
+  for (const child of children.flat()) {
+    if (child !== null && child !== undefined) {
+      node.append(child instanceof Node ? child : String(child));
+    }
+  }
+  return node;
+}
+
+function authHeaders() {
+  const token = sessionStorage.getItem(token_key);
+  return token ? { 'Authorization': 'Bearer ' + token } : {};
+}
+
+async function api(path, options) {
+  const response = await fetch(api_base + path, Object.assign({ headers: authHeaders() }, options));
+  if (response.status === 401) {
+    askToken();
+    throw new Error('the API needs a token');
+  }
+  const body = await response.json();
+  if (!response.ok) {
+    throw new Error(body.error || response.statusText);
+  }
+  return body;
+}
+
+function post(path, form) {
+  return api(path, { method: 'POST', body: new URLSearchParams(form || {}) });
+}
+
+function showMessage(text) {
+  $('message').textContent = text || '';
+  $('message').hidden = !text;
+}
+
+function askToken() {
+  $('token-form').hidden = false;
+  $('sign-out').hidden = true;
+}
+
+function showSignedIn() {
+  const signed_in = sessionStorage.getItem(token_key) !== null;
+  $('sign-out').hidden = !signed_in;
+  if (signed_in) {
+    $('token-form').hidden = true;
+  }
+}
+
+// times the API leaves unset are Go's zero time
+function isSet(time) {
+  return Boolean(time) && !time.startsWith('0001-');
+}
+
+function formatTime(time) {
+  return isSet(time) ? new Date(time).toLocaleString() : '';
+}
+
+function formatDuration(ms) {
+  if (ms < 1000) {
+    return Math.round(ms) + 'ms';
+  }
+  let s = Math.round(ms / 1000);
+  const h = Math.floor(s / 3600);
+  const m = Math.floor(s % 3600 / 60);
+  s %= 60;
+  return (h ? h + 'h ' : '') + (h || m ? m + 'm ' : '') + s + 's';
+}
+
+// a run still going lasts until now
+function runDuration(run) {
+  if (!isSet(run.Started)) {
+    return '';
+  }
+  const finished = isSet(run.Finished) ? new Date(run.Finished) : new Date();
+  return formatDuration(finished - new Date(run.Started));
+}
+
+function stateBadge(state) {
+  return el('span', { className: 'state state-' + state }, state);
+}
+
+function button(label, onclick, disabled) {
+  return el('button', { type: 'button', onclick: onclick, disabled: Boolean(disabled) }, label);
+}
+
+function builderPath() {
+  return '/builders/' + builder.name;
+}
+
+function buildPath(name) {
+  return builderPath() + '/builds/' + name;
+}
+
+async function act(request) {
+  try {
+    await request();
+    await refresh();
+  } catch (err) {
+    showMessage(err.message);
+  }
+}
+
+function showBuilds(builds) {
+  const rows = builds.map(build => {
+    const run = build.last_run;
+    const pending = build.state === 'queued' || build.state === 'running';
+    return el('tr', { className: build.name === selected_build ? 'selected' : '' },
+      el('td', null, el('a', { onclick: () => selectBuild(build.name) }, build.name)),
+      el('td', null, stateBadge(build.state)),
+      el('td', null, run ? ['#' + run.Id + ' ', stateBadge(run.State)] : ''),
+      el('td', null, run ? runDuration(run) : ''),
+      el('td', null, run ? formatTime(run.Started) : ''),
+      el('td', null,
+        button('Trigger', () => act(() => post(buildPath(build.name) + '/trigger', { reason: 'dashboard' }))),
+        ' ',
+        button('Cancel', () => act(() => post(buildPath(build.name) + '/cancel')), !pending)));
+  });
+  $('builds').tBodies[0].replaceChildren(...rows);
+}
+
+function showQueue(queue) {
+  const rows = queue.map(request => el('tr', null,
+    el('td', null, '#' + request.Id),
+    el('td', null, request.Build),
+    el('td', null, request.Reason),
+    el('td', null, request.Requester),
+    el('td', null, request.Priority),
+    el('td', null, formatTime(request.Queued)),
+    el('td', null, button('Drop', () => act(() => api('/queue/' + request.Id, { method: 'DELETE' }))))));
+  $('queue').tBodies[0].replaceChildren(...rows);
+}
+
+function selectBuild(name) {
+  selected_build = name;
+  selected_stage = null;
+  $('stage-section').hidden = true;
+  refresh();
+}
+
+function selectStage(name) {
+  selected_stage = name;
+  refresh();
+}
+
+async function showBuild() {
+  const path = buildPath(selected_build);
+  let stages, runs;
+  try {
+    [stages, runs] = await Promise.all([api(path + '/stages'), api(path + '/runs?limit=10')]);
+  } catch (err) {
+    // the build may be gone
+    selected_build = null;
+    $('build-section').hidden = true;
+    throw err;
+  }
+  $('build-name').textContent = selected_build;
+  $('build-section').hidden = false;
+  $('stages').tBodies[0].replaceChildren(...stages.stages.map(stage =>
+    el('tr', { className: stage.name === selected_stage ? 'selected' : '' },
+      el('td', null, el('a', { onclick: () => selectStage(stage.name) }, stage.name)),
+      el('td', null, stateBadge(stage.state)),
+      el('td', null, stage.depends_on.join(', ')),
+      el('td', null, button('Log', () => followLog(path + '/stages/' + stage.name + '/log',
+        selected_build + ' / ' + stage.name))))));
+  $('runs').tBodies[0].replaceChildren(...runs.runs.map(run =>
+    el('tr', null,
+      el('td', null, '#' + run.Id),
+      el('td', null, stateBadge(run.State)),
+      el('td', null, run.Reason || ''),
+      el('td', null, run.Requester || ''),
+      el('td', null, (run.Commit || '').slice(0, 12)),
+      el('td', null, runDuration(run)),
+      el('td', null, formatTime(run.Started)))));
+  if (selected_stage && !stages.stages.some(stage => stage.name === selected_stage)) {
+    selected_stage = null;
+  }
+  $('stage-section').hidden = !selected_stage;
+  if (selected_stage) {
+    await showStage(path + '/stages/' + selected_stage);
+  }
+}
+
+async function showStage(path) {
+  const commands = await api(path + '/commands');
+  const stage = selected_stage;
+  $('stage-name').textContent = stage;
+  $('commands').tBodies[0].replaceChildren(...commands.commands.map(command =>
+    el('tr', null,
+      el('td', null, command.name),
+      el('td', { className: 'invocation' }, [command.command].concat(command.args).join(' ')),
+      el('td', null, stateBadge(command.state)),
+      el('td', null, command.timeout),
+      el('td', null, button('Log', () => followLog(path + '/commands/' + command.name + '/log',
+        selected_build + ' / ' + stage + ' / ' + command.name))))));
+}
+
+async function refresh() {
+  try {
+    const builders = await api('/builders');
+    builder = builders.builders[0];
+    $('builder-name').textContent = builder.name;
+    $('running').textContent = builder.running.length ? 'running: ' + builder.running.join(', ') : '';
+    const [builds, queue] = await Promise.all([api(builderPath() + '/builds'), api(builderPath() + '/queue')]);
+    showBuilds(builds.builds);
+    showQueue(queue.queue);
+    if (selected_build) {
+      await showBuild();
+    }
+    showMessage('');
+  } catch (err) {
+    showMessage(err.message);
+  }
+}
+
+// a server-sent event of a log: its data is a line, unless it ends the log
+function showLogEvent(event) {
+  const log = $('log');
+  const at_bottom = log.scrollTop + log.clientHeight >= log.scrollHeight - 4;
+  let name = 'message';
+  const data = [];
+  for (const line of event.split('\n')) {
+    if (line.startsWith('event: ')) {
+      name = line.slice(7);
+    } else if (line.startsWith('data: ')) {
+      data.push(line.slice(6));
+    }
+  }
+  if (name !== 'message' || data.length === 0) {
+    return;
+  }
+  log.append(document.createTextNode(data.join('\n') + '\n'));
+  if (at_bottom) {
+    log.scrollTop = log.scrollHeight;
+  }
+}
+
+// streams a log as it is written. EventSource can't send a token, so the
+// events are read from a plain fetch.
+async function followLog(path, name) {
+  stopLog();
+  const controller = new AbortController();
+  log_controller = controller;
+  $('log').textContent = '';
+  $('log-name').textContent = name;
+  $('log-state').textContent = 'following';
+  $('log-section').hidden = false;
+  try {
+    const response = await fetch(api_base + path + '?follow=true',
+      { headers: authHeaders(), signal: controller.signal });
+    if (!response.ok) {
+      const body = await response.json().catch(() => ({}));
+      throw new Error(body.error || response.statusText);
+    }
+    const reader = response.body.getReader();
+    const decoder = new TextDecoder();
+    let pending = '';
+    for (;;) {
+      const { value, done } = await reader.read();
+      if (done) {
+        break;
+      }
+      pending += decoder.decode(value, { stream: true });
+      let end;
+      while ((end = pending.indexOf('\n\n')) >= 0) {
+        showLogEvent(pending.slice(0, end));
+        pending = pending.slice(end + 2);
+      }
+    }
+    $('log-state').textContent = 'complete';
+  } catch (err) {
+    if (err.name !== 'AbortError') {
+      $('log-state').textContent = err.message;
+    }
+  }
+}
+
+function stopLog() {
+  if (log_controller) {
+    log_controller.abort();
+    log_controller = null;
+  }
+}
+
+async function poll() {
+  await refresh();
+  setTimeout(poll, poll_interval);
+}
+
+$('token-form').addEventListener('submit', event => {
+  event.preventDefault();
+  sessionStorage.setItem(token_key, $('token').value.trim());
+  $('token').value = '';
+  showSignedIn();
+  refresh();
+});
+
+$('sign-out').addEventListener('click', () => {
+  sessionStorage.removeItem(token_key);
+  showSignedIn();
+  refresh();
+});
+
+$('build-log').addEventListener('click', () => {
+  followLog(buildPath(selected_build) + '/log', selected_build);
+});
+
+$('log-close').addEventListener('click', () => {
+  stopLog();
+  $('log-section').hidden = true;
+});
+
+showSignedIn();
+poll();
@@ -0,0 +1,251 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	default_poll_interval = time.Minute
+	git_poll_timeout      = time.Minute
+	git_checkout_timeout  = 10 * time.Minute
+)
+
+// SourceBody is the git repository a build checks out into its directory
+type SourceBody struct {
+	Repository   string
+	Branch       string `json:",omitempty"`
+	PollInterval string `json:",omitempty"`
+}
+
+func (s *SourceBody) pollInterval() time.Duration {
+	if d, err := time.ParseDuration(s.PollInterval); err == nil && d > 0 {
+		return d
+	}
+	return default_poll_interval
+}
+
+// a relative local repository is relative to the configuration file
+func (s *SourceBody) repository() string {
+	if filepath.IsAbs(s.Repository) || strings.Contains(s.Repository, ":") {
+		return s.Repository
+	}
+	path := filepath.Join(filepath.Dir(file_json), s.Repository)
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// the remote ref to follow, the default branch when none is set
+func (s *SourceBody) ref() string {
+	if s.Branch == "" {
+		return "HEAD"
+	}
+	return "refs/heads/" + s.Branch
+}
+
+// runs git without prompting for credentials, giving up after timeout
+func git(timeout time.Duration, dir string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return output, fmt.Errorf("git %s: %v: %s", args[0], err, bytes.TrimSpace(output))
+	}
+	return output, nil
+}
+
+// the commit at the head of the followed branch
+func remoteCommit(source *SourceBody) (string, error) {
+	output, err := git(git_poll_timeout, "", "ls-remote", "--exit-code", "--", source.repository(), source.ref())
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("git ls-remote: no commit for %s", source.ref())
+	}
+	return fields[0], nil
+}
+
+// the commit checked out in dir, if it is a repository
+func localCommit(dir string) string {
+	if ok, _ := exists(filepath.Join(dir, ".git")); !ok {
+		return ""
+	}
+	output, err := git(git_poll_timeout, dir, "rev-parse", "HEAD")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// fetches ref, the followed branch by default, into dir and checks out
+// commit, the fetched head by default, leaving files git doesn't track
+// alone. Returns the commit checked out.
+func checkoutSource(source *SourceBody, ref string, commit string, dir string, output func(string)) (string, error) {
+	if ref == "" {
+		ref = source.ref()
+	}
+	if commit == "" {
+		commit = "FETCH_HEAD"
+	}
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return "", err
+	}
+	steps := [][]string{
+		{"fetch", "--quiet", "--no-tags", "--", source.repository(), ref},
+		{"checkout", "--quiet", "--force", "--detach", commit}}
+	if ok, _ := exists(filepath.Join(dir, ".git")); !ok {
+		steps = append([][]string{{"init", "--quiet"}}, steps...)
+	}
+	for _, step := range steps {
+		output("$ git " + strings.Join(step, " "))
+		out, err := git(git_checkout_timeout, dir, step...)
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			output(scanner.Text())
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	checked_out := localCommit(dir)
+	if checked_out == "" {
+		return "", fmt.Errorf("no commit checked out in %s", dir)
+	}
+	return checked_out, nil
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
+
+// polls the repositories of the builds with a Source, queueing a build
+// when a new commit shows up
+func (b *Builder) PollSources() {
+	for range time.Tick(time.Second) {
+		now := time.Now()
+		b.mutex.Lock()
+		var due []*Build
+		for _, build := range b.builds {
+			if build.source != nil && !build.source_polling && !now.Before(build.source_next) {
+				build.source_polling = true
+				build.source_next = now.Add(build.source.pollInterval())
+				due = append(due, build)
+			}
+		}
+		b.mutex.Unlock()
+		for _, build := range due {
+			go b.pollSource(build)
+		}
+	}
+}
+
+func (b *Builder) pollSource(build *Build) {
+	// the source of a build is replaced along with the build, never changed
+	source := build.source
+	b.mutex.Lock()
+	first := !build.source_known
+	b.mutex.Unlock()
+	checked_out := ""
+	if first {
+		checked_out = localCommit(build.directory)
+	}
+	commit, err := remoteCommit(source)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	build.source_polling = false
+	if first {
+		build.source_known = true
+		build.source_commit = checked_out
+	}
+	if err != nil {
+		log.Printf("error: polling %s for %s: %v", source.Repository, build.name, err)
+		return
+	}
+	// a reload replaced or removed the build meanwhile, its replacement is
+	// polled on its own
+	if b.getBuild(build.name) != build {
+		return
+	}
+	// a running or queued build fetches the newest commit when it starts
+	if commit == build.source_commit || build.state == State_running || build.state == State_queued {
+		return
+	}
+	build.source_commit = commit
+	b.enqueue(build, newBuildRequest(build, "new commit "+shortCommit(commit), source.Repository))
+	b.trigger()
+}
+
+// checks out the source of a build when its run starts. A failure goes to
+// the build log and its run, and fails only this build.
+func (b *Builder) checkoutBuild(build *Build) bool {
+	if build.source == nil {
+		return true
+	}
+	output := func(line string) {
+		build.log.WriteString(formatLine("", line))
+	}
+	commit, err := checkoutSource(build.source, build.ref, build.commit, build.directory, output)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err != nil {
+		log.Printf("error: build %s: %v", build.name, err)
+		output("error: " + err.Error())
+		build.run.Error = err.Error()
+		return false
+	}
+	log.Printf("Checked out %s for %s", shortCommit(commit), build.name)
+	build.source_known = true
+	if build.ref == "" || build.ref == build.source.ref() {
+		build.source_commit = commit
+	}
+	build.commit = commit
+	build.run.Commit = commit
+	return true
+}
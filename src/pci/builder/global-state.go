@@ -26,10 +26,40 @@
 
 package builder
 
+import "sync"
+
+// GlobalState tracks the builds in flight, each one running in its own
+// goroutine and reporting through Done once it is finished
 type GlobalState struct {
-	Current_build *Build
+	mutex          sync.Mutex
+	current_builds []*Build
+	Done           chan *Build
 }
 
 func NewGlobalState() *GlobalState {
-	return &GlobalState{Current_build: nil}
+	return &GlobalState{current_builds: nil, Done: make(chan *Build)}
+}
+
+func (g *GlobalState) Add(build *Build) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.current_builds = append(g.current_builds, build)
+}
+
+func (g *GlobalState) Remove(build *Build) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for i, v := range g.current_builds {
+		if v == build {
+			g.current_builds = append(g.current_builds[:i], g.current_builds[i+1:]...)
+			return
+		}
+	}
+}
+
+// number of builds in flight
+func (g *GlobalState) Running() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return len(g.current_builds)
 }
@@ -0,0 +1,96 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type authTokenKey struct{}
+
+// the least role a request needs, none for hooks that are signed with
+// their own secret and for the dashboard, which has no data of its own
+func requiredRole(r *http.Request, method string) string {
+	path := r.URL.Path
+	switch {
+	case regexps["dashboard_re"].MatchString(path):
+		return ""
+	case method == "GET":
+		return role_viewer
+	case regexps["hook_re"].MatchString(path):
+		return ""
+	case regexps["build_trigger_re"].MatchString(path),
+		regexps["build_cancel_re"].MatchString(path),
+		regexps["stage_cancel_re"].MatchString(path),
+		regexps["builder_run_re"].MatchString(path),
+		regexps["request_re"].MatchString(path):
+		return role_operator
+	case regexps["build_re"].MatchString(path) && method == "POST" &&
+		r.PostFormValue("name") == "" && r.PostFormValue("priority") == "":
+		// a state change, the others change the configuration
+		return role_operator
+	}
+	return role_admin
+}
+
+// checks the bearer token of a request against the role it needs, the
+// request returned knows its token. Without tokens everything is allowed.
+func authorize(w http.ResponseWriter, r *http.Request, method string) (*http.Request, bool) {
+	role := requiredRole(r, method)
+	builder.mutex.Lock()
+	tokens := builder.api_tokens
+	builder.mutex.Unlock()
+	if role == "" || len(tokens) == 0 {
+		return r, true
+	}
+	var token *TokenBody
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		token = authenticate(tokens, strings.TrimSpace(authorization[7:]))
+	}
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer realm=\"pci\"")
+		showHttpStatusMessage(w, http.StatusUnauthorized, "a valid bearer token is required")
+		return r, false
+	}
+	r = r.WithContext(context.WithValue(r.Context(), authTokenKey{}, token))
+	if !token.allows(role) {
+		showHttpStatusMessage(w, http.StatusForbidden,
+			fmt.Sprintf("token %s has the %s role, this needs %s", token.Name, token.Role, role))
+		return r, false
+	}
+	return r, true
+}
+
+// the token a request was authorized with, nil when there was none
+func requestToken(r *http.Request) *TokenBody {
+	token, _ := r.Context().Value(authTokenKey{}).(*TokenBody)
+	return token
+}
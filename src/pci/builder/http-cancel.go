@@ -0,0 +1,62 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"net/http"
+)
+
+func cancelBuild(w http.ResponseWriter, r *http.Request) {
+	build := lookupBuild(w, r)
+	if build == nil {
+		return
+	}
+	if err := builder.CancelBuild(build); err != nil {
+		showHttpErrorMessage(w, err.Error())
+		return
+	}
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	showRawBuild(w, r, build)
+}
+
+func cancelStage(w http.ResponseWriter, r *http.Request) {
+	builder.mutex.Lock()
+	build := getBuild(r)
+	stage := getStage(r)
+	builder.mutex.Unlock()
+	if stage == nil {
+		m := "builder/build/stage don't match"
+		showHttpNotFoundMessage(w, m)
+		return
+	}
+	if err := builder.CancelStage(build, stage); err != nil {
+		showHttpErrorMessage(w, err.Error())
+		return
+	}
+	showStage(w, r)
+}
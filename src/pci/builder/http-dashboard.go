@@ -0,0 +1,69 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"embed"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// the dashboard is a page using the /v2 API, with nothing fetched from
+// elsewhere so that it works offline
+//
+//go:embed dashboard
+var dashboard_files embed.FS
+
+// GET /dashboard/{file}, the page itself by default
+func showDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" || r.URL.Path == "/dashboard" {
+		// relative links need the trailing slash, and /v2 must be kept as
+		// the path it came with was stripped of it
+		target := "/dashboard/"
+		if isApiV2(r) {
+			target = api_v2_prefix + target
+		}
+		w.Header().Del("Content-Type")
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/dashboard/")
+	if name == "" {
+		name = "index.html"
+	}
+	content, err := dashboard_files.ReadFile(path.Join("dashboard", name))
+	if err != nil {
+		showHttpNotFoundMessage(w, "no such dashboard file")
+		return
+	}
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(name)))
+	w.Header().Set("Content-Security-Policy", "default-src 'self'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(content)
+}
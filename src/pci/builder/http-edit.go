@@ -0,0 +1,116 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// largest build, stage or command accepted
+const max_edit_body = 1 << 20
+
+// the edit asked for by a POST on the builds, stages or commands of a
+// build, or a PUT, PATCH or DELETE on one of them
+func configEditOf(r *http.Request) *configEdit {
+	// /builders/{b}/builds/{build}/stages/{stage}/commands/{command}
+	parts := strings.Split(r.URL.Path, "/")
+	edit := &configEdit{method: strings.ToUpper(r.Method)}
+	switch {
+	case regexps["builds_re"].MatchString(r.URL.Path):
+	case regexps["build_re"].MatchString(r.URL.Path):
+		edit.name = parts[4]
+	case regexps["stages_re"].MatchString(r.URL.Path):
+		edit.build = parts[4]
+	case regexps["stage_re"].MatchString(r.URL.Path):
+		edit.build, edit.name = parts[4], parts[6]
+	case regexps["commands_re"].MatchString(r.URL.Path):
+		edit.build, edit.stage = parts[4], parts[6]
+	case regexps["command_re"].MatchString(r.URL.Path):
+		edit.build, edit.stage, edit.name = parts[4], parts[6], parts[8]
+	default:
+		return nil
+	}
+	// elements are added to lists, and lists are only added to
+	if (edit.name == "") != (edit.method == "POST") {
+		return nil
+	}
+	return edit
+}
+
+// answers with the status of the first error that has one
+func showHttpErrors(w http.ResponseWriter, errors []error) {
+	status := http.StatusBadRequest
+	var messages []string
+	for _, err := range errors {
+		if herr, ok := err.(*httpError); ok && len(messages) == 0 {
+			status = herr.status
+		}
+		messages = append(messages, err.Error())
+	}
+	showJSON(w, status, errorResponse{Error: messages[0], Errors: messages})
+}
+
+// applies a configuration edit, returns whether the configuration changed
+func handleConfigEdit(w http.ResponseWriter, r *http.Request, edit *configEdit) bool {
+	builder.mutex.Lock()
+	exist := existBuilder(r)
+	builder.mutex.Unlock()
+	if !exist {
+		showHttpBuilderErrorMessage(w)
+		return false
+	}
+	if edit.method != "DELETE" {
+		content, err := ioutil.ReadAll(io.LimitReader(r.Body, max_edit_body+1))
+		if err != nil {
+			showHttpErrorMessage(w, err.Error())
+			return false
+		}
+		if len(content) > max_edit_body {
+			showHttpStatusMessage(w, http.StatusRequestEntityTooLarge, "body too large")
+			return false
+		}
+		edit.content = content
+	}
+	element, errors := builder.EditConfig(edit)
+	if len(errors) > 0 {
+		log.Printf("error: %s %s refused: %v", edit.method, r.URL.Path, errors[0])
+		showHttpErrors(w, errors)
+		return false
+	}
+	log.Printf("%s %s applied", edit.method, r.URL.Path)
+	UpdateJSONFromBuilder(builder, on_disk)
+	status := http.StatusOK
+	if edit.method == "POST" {
+		status = http.StatusCreated
+	}
+	showJSON(w, status, map[string]interface{}{edit.kind(): element})
+	return true
+}
@@ -0,0 +1,279 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const default_listen_address = ":8080"
+
+// ListenBody says where the API is served. It is read at startup only.
+type ListenBody struct {
+	// host:port, ":8080" unless only a Socket is given
+	Address string `json:",omitempty"`
+	// a Unix domain socket, and its permissions in octal (e.g. "0660")
+	Socket     string `json:",omitempty"`
+	SocketMode string `json:",omitempty"`
+	// PEM files serving Address over TLS, read again when they change
+	TLSCert string `json:",omitempty"`
+	TLSKey  string `json:",omitempty"`
+	// TLS clients must present a certificate signed by this CA. It only
+	// secures the transport: roles still come from the bearer tokens
+	ClientCA string `json:",omitempty"`
+}
+
+// override the listen address, socket and TLS files of the configuration
+// when set
+var listen_override ListenBody
+
+func (b *Builder) SetListen(address *string, socket *string, tls_cert *string, tls_key *string, client_ca *string) {
+	listen_override = ListenBody{Address: *address,
+		Socket:   *socket,
+		TLSCert:  *tls_cert,
+		TLSKey:   *tls_key,
+		ClientCA: *client_ca}
+}
+
+// where to listen, with the command line winning over the configuration.
+// Must be called with the mutex held.
+func (b *Builder) listenConfig() ListenBody {
+	var config ListenBody
+	if b.listen != nil {
+		config = *b.listen
+	}
+	for _, field := range []struct {
+		value    *string
+		override string
+	}{{&config.Address, listen_override.Address},
+		{&config.Socket, listen_override.Socket},
+		{&config.TLSCert, listen_override.TLSCert},
+		{&config.TLSKey, listen_override.TLSKey},
+		{&config.ClientCA, listen_override.ClientCA}} {
+		if field.override != "" {
+			*field.value = field.override
+		}
+	}
+	if config.Address == "" && config.Socket == "" {
+		config.Address = default_listen_address
+	}
+	return config
+}
+
+// binds every listener of the configuration, or none
+func listen(config ListenBody) (listeners []net.Listener, err error) {
+	defer func() {
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			listeners = nil
+		}
+	}()
+	// the command line may have broken what the configuration checks
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return nil, fmt.Errorf("can't serve TLS: a certificate and a key go together")
+	}
+	if config.ClientCA != "" && config.TLSCert == "" {
+		return nil, fmt.Errorf("can't check client certificates without TLS")
+	}
+	if config.Address != "" {
+		ln, err := listenTCP(config)
+		if err != nil {
+			return listeners, err
+		}
+		listeners = append(listeners, ln)
+	}
+	if config.Socket != "" {
+		ln, err := listenUnix(configPath(config.Socket), config.SocketMode)
+		if err != nil {
+			return listeners, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+func listenTCP(config ListenBody) (net.Listener, error) {
+	var tls_config *tls.Config
+	if config.TLSCert != "" {
+		var err error
+		if tls_config, err = newTLSConfig(config); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("can't listen on %s: %v", config.Address, err)
+	}
+	if tls_config != nil {
+		log.Printf("Serving the API on https://%s", ln.Addr())
+		return tls.NewListener(ln, tls_config), nil
+	}
+	log.Printf("Serving the API on http://%s", ln.Addr())
+	return ln, nil
+}
+
+// a socket left by a previous run is replaced, one in use or any other
+// file is not
+func listenUnix(socket string, mode string) (net.Listener, error) {
+	if info, err := os.Lstat(socket); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("can't listen on %s: not a socket", socket)
+		}
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("can't listen on %s: already in use", socket)
+		}
+		if err := os.Remove(socket); err != nil {
+			return nil, fmt.Errorf("can't listen on %s: %v", socket, err)
+		}
+	}
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("can't listen on %s: %v", socket, err)
+	}
+	// only its owner can connect unless told otherwise
+	perm := uint64(0600)
+	if mode != "" {
+		perm, _ = strconv.ParseUint(mode, 8, 32)
+	}
+	if err := os.Chmod(socket, os.FileMode(perm)); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("can't listen on %s: %v", socket, err)
+	}
+	log.Printf("Serving the API on unix:%s", socket)
+	return ln, nil
+}
+
+func newTLSConfig(config ListenBody) (*tls.Config, error) {
+	certs := &certReloader{cert_file: configPath(config.TLSCert), key_file: configPath(config.TLSKey)}
+	if err := certs.reload(); err != nil {
+		return nil, fmt.Errorf("can't serve TLS: %v", err)
+	}
+	tls_config := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.getCertificate}
+	if config.ClientCA != "" {
+		content, err := ioutil.ReadFile(configPath(config.ClientCA))
+		if err != nil {
+			return nil, fmt.Errorf("can't read the client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate in the client CA %s", config.ClientCA)
+		}
+		tls_config.ClientCAs = pool
+		tls_config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tls_config, nil
+}
+
+// certReloader serves a certificate, reading it again once its files change
+type certReloader struct {
+	mutex     sync.Mutex
+	cert_file string
+	key_file  string
+	modified  time.Time
+	cert      *tls.Certificate
+}
+
+func lastModified(files ...string) (time.Time, error) {
+	var last time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return last, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// reads the certificate when its files changed; a bad pair, e.g. one half
+// written, leaves the current one in use
+func (c *certReloader) reload() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	modified, err := lastModified(c.cert_file, c.key_file)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && modified.Equal(c.modified) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.cert_file, c.key_file)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil {
+		log.Printf("TLS certificate '%s' reloaded", c.cert_file)
+	}
+	c.cert = &cert
+	c.modified = modified
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := c.reload(); err != nil {
+		log.Printf("error: keeping the current TLS certificate: %v", err)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.cert, nil
+}
+
+func (v *configValidator) validateListen(path string, body *ListenBody) {
+	if body.Address != "" {
+		if _, _, err := net.SplitHostPort(body.Address); err != nil {
+			v.add(joinPath(path, "Address"), "invalid address '%s', expected host:port", body.Address)
+		}
+	}
+	if body.SocketMode != "" {
+		if body.Socket == "" {
+			v.add(joinPath(path, "SocketMode"), "socket mode without a socket")
+		}
+		if mode, err := strconv.ParseUint(body.SocketMode, 8, 32); err != nil || mode > 0777 {
+			v.add(joinPath(path, "SocketMode"), "invalid socket mode '%s', expected octal permissions", body.SocketMode)
+		}
+	}
+	if (body.TLSCert == "") != (body.TLSKey == "") {
+		v.add(path, "TLSCert and TLSKey go together")
+	}
+	if body.ClientCA != "" && body.TLSCert == "" {
+		v.add(joinPath(path, "ClientCA"), "client certificates need TLS")
+	}
+}
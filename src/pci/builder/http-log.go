@@ -0,0 +1,207 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const sse_keepalive = 15 * time.Second
+
+// a log offset comes from the 'offset' parameter or, when an event stream
+// reconnects, from the Last-Event-ID header
+func getLogOffset(r *http.Request) (int64, error) {
+	offset_str := r.FormValue("offset")
+	if offset_str == "" {
+		offset_str = r.Header.Get("Last-Event-ID")
+	}
+	if offset_str == "" {
+		return 0, nil
+	}
+	offset, err := strconv.ParseInt(offset_str, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("log offset is not valid")
+	}
+	return offset, nil
+}
+
+// plain log contents from an offset
+func showLog(w http.ResponseWriter, r *http.Request, l *logStream, offset int64) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fi, err := os.Open(l.path)
+	if err != nil {
+		return
+	}
+	defer fi.Close()
+	if _, err := fi.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	io.Copy(w, fi)
+}
+
+// sends every log line as a server-sent event whose id is the offset right
+// after the line. It ends once the log is complete and nothing is pending.
+func followLog(w http.ResponseWriter, r *http.Request, l *logStream, offset int64, pending func() bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		showHttpErrorMessage(w, "streaming is not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepalive := time.NewTicker(sse_keepalive)
+	defer keepalive.Stop()
+	for {
+		size, active, changed := l.State()
+		if offset > size {
+			// the log was truncated by a new run
+			offset = 0
+		}
+		if offset < size {
+			offset = sendLogEvents(w, l, offset, size)
+			flusher.Flush()
+		}
+		if !active && offset >= size && !pending() {
+			fmt.Fprintf(w, "event: end\ndata: %d\n\n", offset)
+			flusher.Flush()
+			return
+		}
+		select {
+		case <-changed:
+		case <-keepalive.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func sendLogEvents(w http.ResponseWriter, l *logStream, offset int64, size int64) int64 {
+	fi, err := os.Open(l.path)
+	if err != nil {
+		return offset
+	}
+	defer fi.Close()
+	if _, err := fi.Seek(offset, io.SeekStart); err != nil {
+		return offset
+	}
+	reader := bufio.NewReader(io.LimitReader(fi, size-offset))
+	for {
+		line, err := reader.ReadString('\n')
+		if !strings.HasSuffix(line, "\n") {
+			// partial lines wait for the next round
+			return offset
+		}
+		offset += int64(len(line))
+		fmt.Fprintf(w, "id: %d\ndata: %s\n\n", offset, strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			return offset
+		}
+	}
+}
+
+func handleLog(w http.ResponseWriter, r *http.Request, l *logStream, pending func() bool) {
+	offset, err := getLogOffset(r)
+	if err != nil {
+		showHttpErrorMessage(w, err.Error())
+		return
+	}
+	if r.FormValue("follow") == "true" {
+		followLog(w, r, l, offset, pending)
+	} else {
+		showLog(w, r, l, offset)
+	}
+}
+
+func isPending(state int) bool {
+	return state == State_queued || state == State_running
+}
+
+func showBuildLog(w http.ResponseWriter, r *http.Request) {
+	builder.mutex.Lock()
+	if !existBuilder(r) {
+		builder.mutex.Unlock()
+		showHttpBuilderErrorMessage(w)
+		return
+	}
+	build := getBuild(r)
+	builder.mutex.Unlock()
+	if build == nil {
+		showHttpBuildErrorMessage(w)
+		return
+	}
+	handleLog(w, r, build.log, func() bool {
+		builder.mutex.Lock()
+		defer builder.mutex.Unlock()
+		return isPending(build.state)
+	})
+}
+
+func showStageLog(w http.ResponseWriter, r *http.Request) {
+	builder.mutex.Lock()
+	build := getBuild(r)
+	stage := getStage(r)
+	builder.mutex.Unlock()
+	if stage == nil {
+		m := "builder/build/stage don't match"
+		showHttpNotFoundMessage(w, m)
+		return
+	}
+	handleLog(w, r, stage.log, func() bool {
+		builder.mutex.Lock()
+		defer builder.mutex.Unlock()
+		return isPending(build.state) && isPending(stage.state)
+	})
+}
+
+func showCommandLog(w http.ResponseWriter, r *http.Request) {
+	builder.mutex.Lock()
+	build := getBuild(r)
+	stage := getStage(r)
+	command := getCommand(r)
+	builder.mutex.Unlock()
+	if command == nil {
+		m := "builder/build/stage/command don't match"
+		showHttpNotFoundMessage(w, m)
+		return
+	}
+	handleLog(w, r, command.log, func() bool {
+		builder.mutex.Lock()
+		defer builder.mutex.Unlock()
+		return isPending(build.state) && isPending(stage.state)
+	})
+}
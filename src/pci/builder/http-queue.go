@@ -0,0 +1,146 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type requestResponse struct {
+	Request   *buildRequest `json:"request"`
+	Coalesced bool          `json:"coalesced"`
+}
+
+func showRequest(w http.ResponseWriter, request *buildRequest, coalesced bool) {
+	showJSON(w, http.StatusOK, requestResponse{Request: request.redacted(), Coalesced: coalesced})
+}
+
+// whoever asked for a run over HTTP: the name of their token, else who
+// they say they are, else where they are
+func httpRequester(r *http.Request) string {
+	if token := requestToken(r); token != nil {
+		return token.Name
+	}
+	if requester := r.FormValue("requester"); requester != "" {
+		return requester
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func showQueue(w http.ResponseWriter, r *http.Request) {
+	builder.mutex.Lock()
+	exist := existBuilder(r)
+	builder.mutex.Unlock()
+	if !exist {
+		showHttpBuilderErrorMessage(w)
+		return
+	}
+	queue := []*buildRequest{}
+	for _, request := range builder.Queue() {
+		queue = append(queue, request.redacted())
+	}
+	showJSON(w, http.StatusOK, map[string][]*buildRequest{"queue": queue})
+}
+
+// POST /builders/{b}/builds/{build}/trigger, with an optional reason,
+// requester, priority and 'param=name=value' parameters
+func triggerBuild(w http.ResponseWriter, r *http.Request) bool {
+	build := lookupBuild(w, r)
+	if build == nil {
+		return false
+	}
+	reason := r.FormValue("reason")
+	if reason == "" {
+		reason = "api"
+	}
+	builder.mutex.Lock()
+	request := newBuildRequest(build, reason, httpRequester(r))
+	builder.mutex.Unlock()
+	given := make(map[string]string)
+	for _, param := range r.Form["param"] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			showHttpErrorMessage(w, fmt.Sprintf("parameter '%s' is not name=value", param))
+			return false
+		}
+		given[kv[0]] = kv[1]
+	}
+	builder.mutex.Lock()
+	params, err := build.resolveParameters(given)
+	builder.mutex.Unlock()
+	if err != nil {
+		showHttpErrorMessage(w, err.Error())
+		return false
+	}
+	request.Parameters = params
+	if priority := r.FormValue("priority"); priority != "" {
+		p, err := strconv.Atoi(priority)
+		if err != nil {
+			showHttpErrorMessage(w, "request priority is not valid")
+			return false
+		}
+		request.Priority = p
+	}
+	request, coalesced := builder.Enqueue(build, request)
+	UpdateJSONFromBuilder(builder, on_disk)
+	showRequest(w, request, coalesced)
+	return true
+}
+
+func requestId(r *http.Request) int {
+	id, _ := strconv.Atoi(strings.Split(r.URL.Path, "/")[2])
+	return id
+}
+
+func showQueuedRequest(w http.ResponseWriter, r *http.Request) {
+	id := requestId(r)
+	for _, request := range builder.Queue() {
+		if request.Id == id {
+			showRequest(w, &request, false)
+			return
+		}
+	}
+	showHttpStatusMessage(w, http.StatusNotFound, fmt.Sprintf("request %d is not queued", id))
+}
+
+// DELETE /queue/{id}
+func deleteRequest(w http.ResponseWriter, r *http.Request) {
+	request, err := builder.Dequeue(requestId(r))
+	if err != nil {
+		showHttpStatusMessage(w, http.StatusNotFound, err.Error())
+		return
+	}
+	UpdateJSONFromBuilder(builder, on_disk)
+	showRequest(w, request, false)
+}
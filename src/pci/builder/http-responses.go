@@ -0,0 +1,227 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the first API answered with hand-written bodies, some of them not even
+// JSON. Its paths keep those bodies; the same paths under /v2 answer with
+// the types below.
+const api_v2_prefix = "/v2"
+
+type apiVersionKey struct{}
+
+// the methods each resource answers to
+var route_methods = map[string][]string{
+	"builders_re":      {"GET"},
+	"builder_re":       {"GET"},
+	"builder_run_re":   {"POST"},
+	"builds_re":        {"GET", "POST"},
+	"build_re":         {"GET", "POST", "PUT", "PATCH", "DELETE"},
+	"stages_re":        {"GET", "POST"},
+	"stage_re":         {"GET", "PUT", "PATCH", "DELETE"},
+	"commands_re":      {"GET", "POST"},
+	"command_re":       {"PUT", "PATCH", "DELETE"},
+	"build_log_re":     {"GET"},
+	"stage_log_re":     {"GET"},
+	"command_log_re":   {"GET"},
+	"runs_re":          {"GET"},
+	"run_re":           {"GET"},
+	"build_cancel_re":  {"POST"},
+	"stage_cancel_re":  {"POST"},
+	"hook_re":          {"POST"},
+	"queue_re":         {"GET"},
+	"build_trigger_re": {"POST"},
+	"request_re":       {"GET", "DELETE"},
+	"dashboard_re":     {"GET"},
+}
+
+type errorResponse struct {
+	Error  string   `json:"error"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+type builderResponse struct {
+	Name              string   `json:"name"`
+	MaxParallelBuilds int      `json:"max_parallel_builds"`
+	Running           []string `json:"running"`
+}
+
+// as in the first API, the status of a build, stage or command is true
+// only when it succeeded
+type buildResponse struct {
+	Name      string `json:"name"`
+	Directory string `json:"directory"`
+	Priority  int    `json:"priority"`
+	State     string `json:"state"`
+	Status    bool   `json:"status"`
+	Schedule  string `json:"schedule,omitempty"`
+	NextRun   string `json:"next_run,omitempty"`
+	// its latest run, so that listing builds is enough to show them
+	LastRun *BuildRun `json:"last_run,omitempty"`
+}
+
+type stageResponse struct {
+	Name      string   `json:"name"`
+	Priority  int      `json:"priority"`
+	DependsOn []string `json:"depends_on"`
+	State     string   `json:"state"`
+	Status    bool     `json:"status"`
+}
+
+type commandResponse struct {
+	Name      string            `json:"name"`
+	Command   string            `json:"command"`
+	Args      []string          `json:"args"`
+	Shell     bool              `json:"shell"`
+	Directory string            `json:"directory"`
+	Stdio     string            `json:"stdio"`
+	Timeout   string            `json:"timeout"`
+	Env       map[string]string `json:"env"`
+	State     string            `json:"state"`
+	Status    bool              `json:"status"`
+	TimedOut  bool              `json:"timed_out"`
+	Tail      []string          `json:"tail"`
+}
+
+// the methods allowed on a path, nil when there is no such resource
+func allowedMethods(path string) []string {
+	for name, methods := range route_methods {
+		if regexps[name].MatchString(path) {
+			return methods
+		}
+	}
+	return nil
+}
+
+// strips the /v2 prefix, remembering that the request came with it
+func apiRequest(r *http.Request) *http.Request {
+	path := strings.TrimPrefix(r.URL.Path, api_v2_prefix)
+	if path == r.URL.Path || !strings.HasPrefix(path, "/") {
+		return r
+	}
+	r = r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, 2))
+	url := *r.URL
+	url.Path = path
+	r.URL = &url
+	return r
+}
+
+func isApiV2(r *http.Request) bool {
+	version, _ := r.Context().Value(apiVersionKey{}).(int)
+	return version == 2
+}
+
+func showJSON(w http.ResponseWriter, status int, v interface{}) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		content, _ = json.Marshal(errorResponse{Error: err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(content)
+}
+
+// must be called with the mutex held
+func builderResponseOf(b *Builder) builderResponse {
+	running := []string{}
+	for _, build := range b.InFlight() {
+		running = append(running, build.name)
+	}
+	return builderResponse{
+		Name:              b.name,
+		MaxParallelBuilds: b.maxParallelBuilds(),
+		Running:           running,
+	}
+}
+
+// must be called with the mutex held
+func buildResponseOf(b *Builder, build *Build) buildResponse {
+	response := buildResponse{
+		Name:      build.name,
+		Directory: build.directory,
+		Priority:  build.priority,
+		State:     state2str(build.state),
+		Status:    build.state == State_succeeded,
+		LastRun:   b.lastRun(build),
+	}
+	if build.schedule != nil && !build.schedule_next.IsZero() {
+		response.Schedule = build.schedule.spec
+		response.NextRun = build.schedule_next.In(build.schedule.location).Format(time.RFC3339)
+	}
+	return response
+}
+
+func stageResponseOf(stage *Stage) stageResponse {
+	return stageResponse{
+		Name:      stage.name,
+		Priority:  stage.priority,
+		DependsOn: append([]string{}, stage.depends_on...),
+		State:     state2str(stage.state),
+		Status:    stage.state == State_succeeded,
+	}
+}
+
+// must be called with the mutex held
+func commandResponsesOf(build *Build, stage *Stage) []commandResponse {
+	stage_env := builder.stageEnvironment(build, stage)
+	var params map[string]string
+	if build.request != nil {
+		params = build.request.Parameters
+	}
+	responses := []commandResponse{}
+	for _, c := range stage.commands {
+		result := c.Result()
+		// what the last run ran, with its parameters
+		invocation := result.invocation
+		if result.state == State_queued {
+			invocation, _ = c.invocation(nil)
+		}
+		responses = append(responses, commandResponse{
+			Name:      c.name,
+			Command:   invocation.command,
+			Args:      append([]string{}, invocation.args...),
+			Shell:     c.shell,
+			Directory: invocation.dir,
+			Stdio:     c.stdio,
+			Timeout:   duration2str(c.timeout),
+			Env:       redactEnvironment(c.environment(stage_env, params)),
+			State:     state2str(result.state),
+			Status:    result.state == State_succeeded,
+			TimedOut:  result.state == State_timed_out,
+			Tail:      append([]string{}, c.Tail()...),
+		})
+	}
+	return responses
+}
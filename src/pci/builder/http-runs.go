@@ -0,0 +1,87 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// looks up the build of the request, nil after reporting the error
+func lookupBuild(w http.ResponseWriter, r *http.Request) *Build {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	if !existBuilder(r) {
+		showHttpBuilderErrorMessage(w)
+		return nil
+	}
+	if !existBuild(r) {
+		showHttpBuildErrorMessage(w)
+		return nil
+	}
+	return getBuild(r)
+}
+
+func showRuns(w http.ResponseWriter, r *http.Request) {
+	build := lookupBuild(w, r)
+	if build == nil {
+		return
+	}
+	limit := -1
+	if limit_str := r.FormValue("limit"); limit_str != "" {
+		var err error
+		if limit, err = strconv.Atoi(limit_str); err != nil || limit < 0 {
+			showHttpErrorMessage(w, "run limit is not valid")
+			return
+		}
+	}
+	runs, err := builder.BuildRuns(build, r.FormValue("state"), limit)
+	if err != nil {
+		showHttpErrorMessage(w, fmt.Sprintf("runs can't be read (%v)", err))
+		return
+	}
+	for i, run := range runs {
+		runs[i] = run.redacted()
+	}
+	showJSON(w, http.StatusOK, map[string][]*BuildRun{"runs": runs})
+}
+
+func showRun(w http.ResponseWriter, r *http.Request) {
+	build := lookupBuild(w, r)
+	if build == nil {
+		return
+	}
+	id, _ := strconv.Atoi(strings.Split(r.URL.Path, "/")[6])
+	run, err := builder.BuildRun(build, id)
+	if err != nil {
+		showHttpNotFoundMessage(w, "run doesn't exist")
+		return
+	}
+	showJSON(w, http.StatusOK, map[string]*BuildRun{"run": run.redacted()})
+}
@@ -27,6 +27,7 @@
 package builder
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
@@ -45,27 +46,61 @@ const (
 )
 
 var regexps = map[string]*regexp.Regexp{
-	"builders_re":    regexp.MustCompile("^/builders$"),
-	"builder_re":     regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+$"),
-	"builder_run_re": regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/run$"),
-	"builds_re":      regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds$"),
-	"build_re":       regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds/[a-zA-Z0-9-_]+$"),
-	"stages_re":      regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds/[a-zA-Z0-9-_]+/stages$"),
-	"stage_re":       regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds/[a-zA-Z0-9-_]+/stages/[a-zA-Z0-9-_]+$"),
-	"commands_re":    regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds/[a-zA-Z0-9-_]+/stages/[a-zA-Z0-9-_]+/commands$"),
+	"builders_re":      regexp.MustCompile("^/builders$"),
+	"builder_re":       regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+$"),
+	"builder_run_re":   regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/run$"),
+	"builds_re":        regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds$"),
+	"build_re":         regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds/[a-zA-Z0-9-_]+$"),
+	"stages_re":        regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds/[a-zA-Z0-9-_]+/stages$"),
+	"stage_re":         regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds/[a-zA-Z0-9-_]+/stages/[a-zA-Z0-9-_]+$"),
+	"commands_re":      regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds/[a-zA-Z0-9-_]+/stages/[a-zA-Z0-9-_]+/commands$"),
+	"build_log_re":     regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds/[a-zA-Z0-9-_]+/log$"),
+	"stage_log_re":     regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds/[a-zA-Z0-9-_]+/stages/[a-zA-Z0-9-_]+/log$"),
+	"command_log_re":   regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds/[a-zA-Z0-9-_]+/stages/[a-zA-Z0-9-_]+/commands/[a-zA-Z0-9-_]+/log$"),
+	"runs_re":          regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds/[a-zA-Z0-9-_]+/runs$"),
+	"run_re":           regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds/[a-zA-Z0-9-_]+/runs/[0-9]+$"),
+	"build_cancel_re":  regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds/[a-zA-Z0-9-_]+/cancel$"),
+	"stage_cancel_re":  regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds/[a-zA-Z0-9-_]+/stages/[a-zA-Z0-9-_]+/cancel$"),
+	"hook_re":          regexp.MustCompile("^/hooks/[a-zA-Z0-9-_]+/[a-zA-Z0-9-_]+$"),
+	"queue_re":         regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/queue$"),
+	"build_trigger_re": regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds/[a-zA-Z0-9-_]+/trigger$"),
+	"request_re":       regexp.MustCompile("^/queue/[0-9]+$"),
+	"command_re":       regexp.MustCompile("^/builders/[a-zA-Z0-9-_]+/builds/[a-zA-Z0-9-_]+/stages/[a-zA-Z0-9-_]+/commands/[a-zA-Z0-9-_]+$"),
+	"dashboard_re":     regexp.MustCompile("^/$|^/dashboard(/[a-z-]*(\\.[a-z]+)?)?$"),
+}
+
+// httpError is a request that failed, with the status to answer
+type httpError struct {
+	status  int
+	message string
+}
+
+func (e *httpError) Error() string {
+	return e.message
+}
+
+func newHttpError(status int, format string, a ...interface{}) *httpError {
+	return &httpError{status: status, message: fmt.Sprintf(format, a...)}
+}
+
+func showHttpStatusMessage(w http.ResponseWriter, status int, m string) {
+	showJSON(w, status, errorResponse{Error: m})
 }
 
 func showHttpErrorMessage(w http.ResponseWriter, m string) {
-	w.WriteHeader(http.StatusBadRequest)
-	fmt.Fprintf(w, "{ \"error\": \"%s\" }", m)
+	showHttpStatusMessage(w, http.StatusBadRequest, m)
+}
+
+func showHttpNotFoundMessage(w http.ResponseWriter, m string) {
+	showHttpStatusMessage(w, http.StatusNotFound, m)
 }
 
 func showHttpBuilderErrorMessage(w http.ResponseWriter) {
-	showHttpErrorMessage(w, "builder name doesn't match")
+	showHttpNotFoundMessage(w, "builder name doesn't match")
 }
 
 func showHttpBuildErrorMessage(w http.ResponseWriter) {
-	showHttpErrorMessage(w, "build name doesn't match")
+	showHttpNotFoundMessage(w, "build name doesn't match")
 }
 
 func existBuilder(r *http.Request) bool {
@@ -74,6 +109,9 @@ func existBuilder(r *http.Request) bool {
 }
 
 func getBuild(r *http.Request) (build *Build) {
+	if !existBuilder(r) {
+		return nil
+	}
 	build_name := strings.Split(r.URL.Path, "/")[4]
 	for _, v := range builder.builds {
 		if v.name == build_name {
@@ -105,23 +143,68 @@ func existStage(r *http.Request) bool {
 	return getStage(r) != nil
 }
 
+func getCommand(r *http.Request) (command *shellCommand) {
+	stage := getStage(r)
+	if stage == nil {
+		return nil
+	}
+	command_name := strings.Split(r.URL.Path, "/")[8]
+	for _, v := range stage.commands {
+		if v.name == command_name {
+			return v
+		}
+	}
+	return nil
+}
+
+func existCommand(r *http.Request) bool {
+	return getCommand(r) != nil
+}
+
 func showBuilders(w http.ResponseWriter, r *http.Request) {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	if isApiV2(r) {
+		showJSON(w, http.StatusOK, map[string][]builderResponse{"builders": {builderResponseOf(builder)}})
+		return
+	}
 	fmt.Fprintf(w, "{ \"builders\": [ \"%s\" ] }", builder.name)
 }
 
 func showBuilder(w http.ResponseWriter, r *http.Request) {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
 	if !existBuilder(r) {
 		showHttpBuilderErrorMessage(w)
 		return
 	}
-	fmt.Fprintf(w, "{ \"builder\": { \"name\": \"%s\" } }", builder.name)
+	response := builderResponseOf(builder)
+	if isApiV2(r) {
+		showJSON(w, http.StatusOK, map[string]builderResponse{"builder": response})
+		return
+	}
+	content, _ := json.Marshal(response.Running)
+	fmt.Fprintf(w, "{ \"builder\": { \"name\": \"%s\", \"max_parallel_builds\": %d, \"running\": %s } }",
+		response.Name,
+		response.MaxParallelBuilds,
+		content)
 }
 
 func showBuilds(w http.ResponseWriter, r *http.Request) {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
 	if !existBuilder(r) {
 		showHttpBuilderErrorMessage(w)
 		return
 	}
+	if isApiV2(r) {
+		builds := []buildResponse{}
+		for _, build := range builder.builds {
+			builds = append(builds, buildResponseOf(builder, build))
+		}
+		showJSON(w, http.StatusOK, map[string][]buildResponse{"builds": builds})
+		return
+	}
 	fmt.Fprintf(w, "{ \"builds\": [ ")
 	end := len(builder.builds) - 1
 	for i, v := range builder.builds {
@@ -134,16 +217,30 @@ func showBuilds(w http.ResponseWriter, r *http.Request) {
 }
 
 func showRawBuild(w http.ResponseWriter, r *http.Request, build *Build) {
+	response := buildResponseOf(builder, build)
+	if isApiV2(r) {
+		showJSON(w, http.StatusOK, map[string]buildResponse{"build": response})
+		return
+	}
+	schedule := ""
+	if response.Schedule != "" {
+		schedule = fmt.Sprintf(", { \"schedule\" : \"%s\" }, { \"next_run\" : \"%s\" }",
+			response.Schedule,
+			response.NextRun)
+	}
 	fmt.Fprintf(w,
-		"{ \"build\": { { \"name\": \"%s\" }, { \"directory\": \"%s\" }, { \"priority\" : %d }, { \"state\" : %d }, { \"status\" : \"%s\" } } }",
-		build.name,
-		build.directory,
-		build.priority,
-		build.state,
-		strconv.FormatBool(build.status))
+		"{ \"build\": { { \"name\": \"%s\" }, { \"directory\": \"%s\" }, { \"priority\" : %d }, { \"state\" : \"%s\" }, { \"status\" : \"%s\" }%s } }",
+		response.Name,
+		response.Directory,
+		response.Priority,
+		response.State,
+		strconv.FormatBool(response.Status),
+		schedule)
 }
 
 func showBuild(w http.ResponseWriter, r *http.Request) {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
 	if !existBuilder(r) {
 		showHttpBuilderErrorMessage(w)
 		return
@@ -152,17 +249,12 @@ func showBuild(w http.ResponseWriter, r *http.Request) {
 		showHttpBuildErrorMessage(w)
 		return
 	}
-	build := getBuild(r)
-	fmt.Fprintf(w,
-		"{ \"build\": { { \"name\": \"%s\" }, { \"directory\": \"%s\" }, { \"priority\" : %d }, { \"state\" : %d }, { \"status\" : \"%s\" } } }",
-		build.name,
-		build.directory,
-		build.priority,
-		build.state,
-		strconv.FormatBool(build.status))
+	showRawBuild(w, r, getBuild(r))
 }
 
 func showStages(w http.ResponseWriter, r *http.Request) {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
 	if !existBuilder(r) {
 		showHttpBuilderErrorMessage(w)
 		return
@@ -172,6 +264,14 @@ func showStages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	build := getBuild(r)
+	if isApiV2(r) {
+		stages := []stageResponse{}
+		for _, stage := range build.stages {
+			stages = append(stages, stageResponseOf(stage))
+		}
+		showJSON(w, http.StatusOK, map[string][]stageResponse{"stages": stages})
+		return
+	}
 	fmt.Fprintf(w, "{ \"stages\": [ ")
 	end := len(build.stages) - 1
 	for i, v := range build.stages {
@@ -184,31 +284,47 @@ func showStages(w http.ResponseWriter, r *http.Request) {
 }
 
 func showStage(w http.ResponseWriter, r *http.Request) {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
 	if !existStage(r) {
 		m := "builder/build/stage don't match"
-		showHttpErrorMessage(w, m)
+		showHttpNotFoundMessage(w, m)
 		return
 	}
-	stage := getStage(r)
+	response := stageResponseOf(getStage(r))
+	if isApiV2(r) {
+		showJSON(w, http.StatusOK, map[string]stageResponse{"stage": response})
+		return
+	}
+	depends_on, _ := json.Marshal(response.DependsOn)
 	fmt.Fprintf(w,
-		"{ \"stage\": { { \"name\": \"%s\" }, { \"priority\" : %d }, { \"state\" : %d }, { \"status\" : \"%v\" } } }",
-		stage.name,
-		stage.priority,
-		stage.state,
-		stage.status)
+		"{ \"stage\": { { \"name\": \"%s\" }, { \"priority\" : %d }, { \"depends_on\" : %s }, { \"state\" : \"%s\" }, { \"status\" : \"%s\" } } }",
+		response.Name,
+		response.Priority,
+		depends_on,
+		response.State,
+		strconv.FormatBool(response.Status))
 }
 
 func showCommands(w http.ResponseWriter, r *http.Request) {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
 	if !existStage(r) {
 		m := "builder/build/stage don't match"
-		showHttpErrorMessage(w, m)
+		showHttpNotFoundMessage(w, m)
+		return
+	}
+	commands := commandResponsesOf(getBuild(r), getStage(r))
+	if isApiV2(r) {
+		showJSON(w, http.StatusOK, map[string][]commandResponse{"commands": commands})
 		return
 	}
-	commands := getStage(r).commands
 	end := len(commands) - 1
 	fmt.Fprintf(w, "{ \"commands\" : [ ")
 	for i, c := range commands {
-		fmt.Fprintf(w, "{ \"name\": \"%s\", \"command\": \"%s\", \"params\": \"%s\", \"dir\": \"%s\", \"stdio\": \"%s\", \"status\": \"%s\" }", c.name, c.command, c.params, c.dir, c.stdio, strconv.FormatBool(c.status))
+		env, _ := json.Marshal(c.Env)
+		tail, _ := json.Marshal(c.Tail)
+		fmt.Fprintf(w, "{ \"name\": \"%s\", \"command\": \"%s\", \"params\": \"%s\", \"shell\": \"%s\", \"dir\": \"%s\", \"stdio\": \"%s\", \"timeout\": \"%s\", \"env\": %s, \"state\": \"%s\", \"status\": \"%s\", \"timed_out\": \"%s\", \"tail\": %s }", c.Name, c.Command, strings.Join(c.Args, " "), strconv.FormatBool(c.Shell), c.Directory, c.Stdio, c.Timeout, env, c.State, strconv.FormatBool(c.Status), strconv.FormatBool(c.TimedOut), tail)
 		if i != end {
 			fmt.Fprintf(w, ", ")
 		}
@@ -232,6 +348,22 @@ func handleGetMethod(w http.ResponseWriter, r *http.Request) {
 		showStage(w, r)
 	case regexps["commands_re"].MatchString(r.URL.Path):
 		showCommands(w, r)
+	case regexps["build_log_re"].MatchString(r.URL.Path):
+		showBuildLog(w, r)
+	case regexps["stage_log_re"].MatchString(r.URL.Path):
+		showStageLog(w, r)
+	case regexps["command_log_re"].MatchString(r.URL.Path):
+		showCommandLog(w, r)
+	case regexps["runs_re"].MatchString(r.URL.Path):
+		showRuns(w, r)
+	case regexps["run_re"].MatchString(r.URL.Path):
+		showRun(w, r)
+	case regexps["queue_re"].MatchString(r.URL.Path):
+		showQueue(w, r)
+	case regexps["request_re"].MatchString(r.URL.Path):
+		showQueuedRequest(w, r)
+	case regexps["dashboard_re"].MatchString(r.URL.Path):
+		showDashboard(w, r)
 	default:
 		m := fmt.Sprintf("resource doesn't exist (%s)", r.URL.Path)
 		log.Printf("error: %s\n", m)
@@ -240,75 +372,99 @@ func handleGetMethod(w http.ResponseWriter, r *http.Request) {
 	httpd_c <- Httpd_no_action
 }
 
-func updateBuildName(w http.ResponseWriter, r *http.Request) {
-	if !existBuilder(r) {
+// changes a build the way a PATCH with patch does, so the change is
+// checked and saved like any other edit, and shows the build under the name
+// it ends up with
+func patchBuild(w http.ResponseWriter, r *http.Request, patch map[string]interface{}) bool {
+	builder.mutex.Lock()
+	exist := existBuilder(r)
+	builder.mutex.Unlock()
+	if !exist {
 		showHttpBuilderErrorMessage(w)
-		return
+		return false
 	}
-	if !existBuild(r) {
-		showHttpBuildErrorMessage(w)
-		return
+	content, _ := json.Marshal(patch)
+	edit := &configEdit{method: "PATCH", name: strings.Split(r.URL.Path, "/")[4], content: content}
+	element, errors := builder.EditConfig(edit)
+	if len(errors) > 0 {
+		log.Printf("error: %s %s refused: %v", edit.method, r.URL.Path, errors[0])
+		showHttpErrors(w, errors)
+		return false
 	}
-	build := getBuild(r)
-	new_name := r.PostFormValue("name")
-	if new_name != "" {
-		build.name = new_name
-		UpdateJSONFromBuilder(builder, on_disk)
-	} else {
-		m := "build name is not valid"
-		showHttpErrorMessage(w, m)
-		return
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	build := builder.getBuild(element.(BuildBody).Name)
+	if build == nil {
+		showHttpBuildErrorMessage(w)
+		return false
 	}
 	showRawBuild(w, r, build)
+	return true
 }
 
-func updateBuildPriority(w http.ResponseWriter, r *http.Request) {
-	if !existBuilder(r) {
-		showHttpBuilderErrorMessage(w)
-		return
-	}
-	if !existBuild(r) {
-		showHttpBuildErrorMessage(w)
-		return
-	}
-	build := getBuild(r)
-	new_priority_str := r.PostFormValue("priority")
-	if new_priority, err := strconv.Atoi(new_priority_str); err == nil {
-		build.priority = new_priority
-		UpdateJSONFromBuilder(builder, on_disk)
-	} else {
-		m := "build priority is not valid"
-		showHttpErrorMessage(w, m)
-		return
+func updateBuildName(w http.ResponseWriter, r *http.Request) bool {
+	return patchBuild(w, r, map[string]interface{}{"Name": r.PostFormValue("name")})
+}
+
+func updateBuildPriority(w http.ResponseWriter, r *http.Request) bool {
+	priority, err := strconv.Atoi(r.PostFormValue("priority"))
+	if err != nil {
+		showHttpErrorMessage(w, "build priority is not valid")
+		return false
 	}
-	showRawBuild(w, r, build)
+	return patchBuild(w, r, map[string]interface{}{"Priority": priority})
 }
 
-func updateBuildState(w http.ResponseWriter, r *http.Request) {
+func updateBuildState(w http.ResponseWriter, r *http.Request) bool {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
 	if !existBuilder(r) {
 		showHttpBuilderErrorMessage(w)
-		return
+		return false
 	}
 	if !existBuild(r) {
 		showHttpBuildErrorMessage(w)
-		return
+		return false
 	}
 	build := getBuild(r)
-	new_state_str := r.PostFormValue("state")
-	new_state := str2state(new_state_str)
-	if new_state != State_undefined {
-		build.state = new_state
-		UpdateJSONFromBuilder(builder, on_disk)
-	} else {
-		m := "build state is not valid"
-		showHttpErrorMessage(w, m)
-		return
+	new_state := str2state(r.PostFormValue("state"))
+	if new_state == State_undefined {
+		showHttpErrorMessage(w, "build state is not valid")
+		return false
+	}
+	// only the scheduler starts builds
+	if new_state == State_running {
+		showHttpErrorMessage(w, "build state can't be set to running")
+		return false
+	}
+	// queueing a build requests a run of it
+	if new_state == State_queued {
+		state := build.state
+		if err := transition(&state, new_state); err != nil {
+			showHttpErrorMessage(w, fmt.Sprintf("build %s: %v", build.name, err))
+			return false
+		}
+		builder.enqueue(build, newBuildRequest(build, "state", httpRequester(r)))
+		showRawBuild(w, r, build)
+		return true
+	}
+	was_queued := build.state == State_queued
+	if err := build.setState(new_state); err != nil {
+		showHttpErrorMessage(w, err.Error())
+		return false
+	}
+	if was_queued {
+		builder.dropRequests(build.name)
 	}
 	showRawBuild(w, r, build)
+	return true
 }
 
 func handleBuilderRun(w http.ResponseWriter, r *http.Request) bool {
-	if !existBuilder(r) {
+	builder.mutex.Lock()
+	exist := existBuilder(r)
+	builder.mutex.Unlock()
+	if !exist {
 		showHttpBuilderErrorMessage(w)
 		return false
 	}
@@ -318,21 +474,54 @@ func handleBuilderRun(w http.ResponseWriter, r *http.Request) bool {
 
 func handlePostMethod(w http.ResponseWriter, r *http.Request) {
 	switch {
+	case regexps["builds_re"].MatchString(r.URL.Path),
+		regexps["stages_re"].MatchString(r.URL.Path),
+		regexps["commands_re"].MatchString(r.URL.Path):
+		handleEditMethod(w, r)
+		return
 	case regexps["build_re"].MatchString(r.URL.Path):
 		switch {
 		case r.PostFormValue("name") != "":
-			updateBuildName(w, r)
+			if updateBuildName(w, r) {
+				UpdateJSONFromBuilder(builder, on_disk)
+			}
 			httpd_c <- Httpd_run_build
 			return
 		case r.PostFormValue("priority") != "":
-			updateBuildPriority(w, r)
+			if updateBuildPriority(w, r) {
+				UpdateJSONFromBuilder(builder, on_disk)
+			}
 			httpd_c <- Httpd_run_build
 			return
 		case r.PostFormValue("state") != "":
-			updateBuildState(w, r)
+			if updateBuildState(w, r) {
+				UpdateJSONFromBuilder(builder, on_disk)
+			}
 			httpd_c <- Httpd_run_build
 			return
 		}
+	case regexps["build_cancel_re"].MatchString(r.URL.Path):
+		cancelBuild(w, r)
+		httpd_c <- Httpd_no_action
+		return
+	case regexps["stage_cancel_re"].MatchString(r.URL.Path):
+		cancelStage(w, r)
+		httpd_c <- Httpd_no_action
+		return
+	case regexps["build_trigger_re"].MatchString(r.URL.Path):
+		if triggerBuild(w, r) {
+			httpd_c <- Httpd_run_build
+		} else {
+			httpd_c <- Httpd_no_action
+		}
+		return
+	case regexps["hook_re"].MatchString(r.URL.Path):
+		if handleHook(w, r) {
+			httpd_c <- Httpd_run_build
+		} else {
+			httpd_c <- Httpd_no_action
+		}
+		return
 	case regexps["builder_run_re"].MatchString(r.URL.Path):
 		if handleBuilderRun(w, r) {
 			httpd_c <- Httpd_run_build
@@ -347,32 +536,97 @@ func handlePostMethod(w http.ResponseWriter, r *http.Request) {
 	httpd_c <- Httpd_no_action
 }
 
+func handleDeleteMethod(w http.ResponseWriter, r *http.Request) {
+	if regexps["request_re"].MatchString(r.URL.Path) {
+		deleteRequest(w, r)
+		httpd_c <- Httpd_no_action
+		return
+	}
+	handleEditMethod(w, r)
+}
+
+// PUT, PATCH and DELETE change the configuration
+func handleEditMethod(w http.ResponseWriter, r *http.Request) {
+	edit := configEditOf(r)
+	if edit == nil {
+		m := fmt.Sprintf("resource doesn't exist (%s)", r.URL.Path)
+		log.Printf("error: %s\n", m)
+		showHttpErrorMessage(w, m)
+		httpd_c <- Httpd_no_action
+		return
+	}
+	if handleConfigEdit(w, r, edit) {
+		httpd_c <- Httpd_run_build
+	} else {
+		httpd_c <- Httpd_no_action
+	}
+}
+
 func dispatcher(w http.ResponseWriter, r *http.Request) {
-	switch strings.ToUpper(r.Method) {
+	r = apiRequest(r)
+	w.Header().Set("Content-Type", "application/json")
+	methods := allowedMethods(r.URL.Path)
+	if methods == nil {
+		m := fmt.Sprintf("resource doesn't exist (%s)", r.URL.Path)
+		log.Printf("error: %s\n", m)
+		showHttpNotFoundMessage(w, m)
+		httpd_c <- Httpd_no_action
+		return
+	}
+	method := strings.ToUpper(r.Method)
+	allowed := false
+	for _, m := range methods {
+		allowed = allowed || m == method
+	}
+	if !allowed {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		showHttpStatusMessage(w, http.StatusMethodNotAllowed,
+			fmt.Sprintf("http method %s not supported by %s", method, r.URL.Path))
+		httpd_c <- Httpd_no_action
+		return
+	}
+	// whatever isn't a GET is audited, refused or not
+	var audit *auditWriter
+	if method != "GET" {
+		audit = &auditWriter{ResponseWriter: w, status: http.StatusOK, build: auditBuild(r)}
+		w = audit
+		defer func() { builder.audit(r, audit) }()
+	}
+	r, authorized := authorize(w, r, method)
+	if !authorized {
+		httpd_c <- Httpd_no_action
+		return
+	}
+	switch method {
 	case "GET":
 		handleGetMethod(w, r)
 	case "POST":
 		handlePostMethod(w, r)
-	default:
-		fmt.Fprintf(w, "http method not supported\n")
+	case "PUT", "PATCH":
+		handleEditMethod(w, r)
+	case "DELETE":
+		handleDeleteMethod(w, r)
 	}
 }
 
-func HttpServer(b *Builder) chan int {
+// serves the API on every configured listener, failing when one of them
+// can't be bound
+func HttpServer(b *Builder) (chan int, error) {
 	builder = b
 	httpd_c = make(chan int)
-	go func() {
-		http.HandleFunc("/", dispatcher)
-		ln, err := net.Listen("tcp", ":8080")
-		if err != nil {
-			log.Printf("error Listen\n")
-		}
-		for {
-			err = http.Serve(ln, nil)
-			if err != nil {
-				continue
-			}
-		}
-	}()
-	return httpd_c
+	b.mutex.Lock()
+	config := b.listenConfig()
+	b.mutex.Unlock()
+	listeners, err := listen(config)
+	if err != nil {
+		return nil, err
+	}
+	http.HandleFunc("/", dispatcher)
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			err := http.Serve(ln, nil)
+			log.Fatalf("error: serving the API on %s stopped: %v", ln.Addr(), err)
+		}(ln)
+	}
+	return httpd_c, nil
 }
@@ -0,0 +1,93 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// the build a hook is sent to, with the webhook it was configured with
+func lookupHookBuild(r *http.Request) (*Build, *WebhookBody) {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	if !existBuilder(r) {
+		return nil, nil
+	}
+	build_name := strings.Split(r.URL.Path, "/")[3]
+	for _, build := range builder.builds {
+		if build.name == build_name && build.webhook != nil {
+			return build, build.webhook
+		}
+	}
+	return nil, nil
+}
+
+// POST /hooks/{builder}/{build}, returns whether the build was queued
+func handleHook(w http.ResponseWriter, r *http.Request) bool {
+	build, webhook := lookupHookBuild(r)
+	if build == nil {
+		showHttpStatusMessage(w, http.StatusNotFound, "no webhook for this build")
+		return false
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, max_hook_payload+1))
+	if err != nil {
+		showHttpErrorMessage(w, err.Error())
+		return false
+	}
+	if len(body) > max_hook_payload {
+		showHttpStatusMessage(w, http.StatusRequestEntityTooLarge, "payload too large")
+		return false
+	}
+	if herr := verifyHook(r.Header, body, webhook.Secret); herr != nil {
+		log.Printf("error: hook for %s refused: %s", build.name, herr.message)
+		showHttpStatusMessage(w, herr.status, herr.message)
+		return false
+	}
+	event, herr := parseHook(r.Header, r.Header.Get("Content-Type"), body)
+	if herr != nil {
+		log.Printf("error: hook for %s: %s", build.name, herr.message)
+		showHttpStatusMessage(w, herr.status, herr.message)
+		return false
+	}
+	var request *buildRequest
+	coalesced := false
+	if event.ignored == "" {
+		request, coalesced = builder.QueueFromHook(build, event)
+	}
+	if event.ignored != "" {
+		log.Printf("Hook for %s ignored: %s", build.name, event.ignored)
+		showJSON(w, http.StatusOK, map[string]string{"ignored": event.ignored})
+		return false
+	}
+	UpdateJSONFromBuilder(builder, on_disk)
+	showRequest(w, request, coalesced)
+	return true
+}
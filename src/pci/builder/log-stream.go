@@ -0,0 +1,117 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// logStream is an append-only log file that readers can follow while it is
+// being written
+type logStream struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	changed chan struct{}
+}
+
+func newLogStream(path string) *logStream {
+	return &logStream{path: path, changed: make(chan struct{})}
+}
+
+// wakes up every follower, must be called with the mutex held
+func (l *logStream) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *logStream) Open(truncate bool) error {
+	flags := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0770); err != nil {
+		return err
+	}
+	fo, err := os.OpenFile(l.path, flags, 0660)
+	if err != nil {
+		return err
+	}
+	info, err := fo.Stat()
+	if err != nil {
+		fo.Close()
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.file = fo
+	l.size = info.Size()
+	l.notify()
+	return nil
+}
+
+func (l *logStream) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	l.notify()
+	return err
+}
+
+func (l *logStream) WriteString(str string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	n, err := l.file.WriteString(str)
+	l.size += int64(n)
+	l.notify()
+	return err
+}
+
+// current size, whether it is still being written and a channel closed on
+// the next change
+func (l *logStream) State() (int64, bool, chan struct{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		if info, err := os.Stat(l.path); err == nil {
+			l.size = info.Size()
+		} else {
+			l.size = 0
+		}
+	}
+	return l.size, l.file != nil, l.changed
+}
@@ -0,0 +1,153 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// runStore keeps every BuildRun as a JSON file under
+// <directory>/<builder>/<build>/runs/<id>.json
+type runStore struct {
+	mutex     sync.Mutex
+	directory string
+}
+
+func newRunStore(directory string) *runStore {
+	return &runStore{directory: directory}
+}
+
+func (s *runStore) runsDirectory(builder_name string, build_name string) string {
+	return filepath.Join(s.directory, builder_name, build_name, "runs")
+}
+
+// where the logs of a build go when its directory is a checkout
+func (s *runStore) logsDirectory(builder_name string, build_name string) string {
+	return filepath.Join(s.directory, builder_name, build_name, "logs")
+}
+
+func (s *runStore) runIds(builder_name string, build_name string) ([]int, error) {
+	entries, err := ioutil.ReadDir(s.runsDirectory(builder_name, build_name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if id, err := strconv.Atoi(strings.TrimSuffix(name, ".json")); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// creates and saves a new run numbered after the last one on disk
+func (s *runStore) Begin(builder_name string, build *Build) (*BuildRun, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ids, err := s.runIds(builder_name, build.name)
+	if err != nil {
+		return nil, err
+	}
+	id := 1
+	if len(ids) > 0 {
+		id = ids[len(ids)-1] + 1
+	}
+	run := newBuildRun(id, build)
+	return run, s.save(builder_name, run)
+}
+
+func (s *runStore) Save(builder_name string, run *BuildRun) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.save(builder_name, run)
+}
+
+func (s *runStore) save(builder_name string, run *BuildRun) error {
+	dir := s.runsDirectory(builder_name, run.Build)
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(run, "", "   ")
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(dir, strconv.Itoa(run.Id)+".json")
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0660); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func (s *runStore) Get(builder_name string, build_name string, id int) (*BuildRun, error) {
+	file := filepath.Join(s.runsDirectory(builder_name, build_name), strconv.Itoa(id)+".json")
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var run BuildRun
+	if err := json.Unmarshal(content, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// runs of a build in the given state, or in any when it is empty, newest
+// first. Runs are read until there are limit of them, all of them when
+// limit is negative.
+func (s *runStore) List(builder_name string, build_name string, state string, limit int) ([]*BuildRun, error) {
+	ids, err := s.runIds(builder_name, build_name)
+	if err != nil {
+		return nil, err
+	}
+	runs := []*BuildRun{}
+	for i := len(ids) - 1; i >= 0 && (limit < 0 || len(runs) < limit); i-- {
+		run, err := s.Get(builder_name, build_name, ids[i])
+		if err != nil {
+			return nil, err
+		}
+		if state == "" || run.State == state {
+			runs = append(runs, run)
+		}
+	}
+	return runs, nil
+}
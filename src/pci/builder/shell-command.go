@@ -27,59 +27,236 @@
 package builder
 
 import (
-	"bytes"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// time given to a timed out process group between SIGTERM and SIGKILL
+const kill_grace_period = 10 * time.Second
+
 type shellCommand struct {
 	name    string
 	command string
-	params  string
+	params  []string
+	shell   bool
 	dir     string
 	stdio   string
-	status  bool
+	timeout time.Duration
+	env     map[string]string
+	mutex   sync.Mutex
+	result  commandResult
+	log     *logStream
+	logs    []*logStream
+	tail    []string
+	// the first error writing to logs during the last execution
+	log_err error
+}
+
+// outcome of the last execution, guarded by the command mutex. Its state is
+// queued until the command runs.
+type commandResult struct {
+	state     int
+	exit_code int
+	started   time.Time
+	finished  time.Time
+	// what ran, with secret parameters hidden
+	invocation commandInvocation
+}
+
+// what a command runs, with the parameters of its build substituted
+type commandInvocation struct {
+	command string
+	args    []string
+	dir     string
+	// command and args are a line for the shell
+	shell bool
+}
+
+// the command line as the shell runs it, or as it would have to be typed
+func (i commandInvocation) line() string {
+	words := append([]string{i.command}, i.args...)
+	if !i.shell {
+		for j, word := range words {
+			words[j] = shellQuote(word)
+		}
+	}
+	return strings.Join(words, " ")
 }
 
 func NewShellCommand(
 	name string,
 	command string,
-	params string,
+	params []string,
+	shell bool,
 	dir string,
-	stdio string) *shellCommand {
+	stdio string,
+	timeout time.Duration,
+	env map[string]string) *shellCommand {
 	return &shellCommand{
 		name:    name,
 		command: command,
 		params:  params,
+		shell:   shell,
 		dir:     dir,
 		stdio:   stdio,
-		status:  false}
+		timeout: timeout,
+		env:     env,
+		result:  commandResult{state: State_queued, exit_code: -1}}
 }
 
-func (c *shellCommand) Execute() {
-	var out []byte
-	var ok bool
-	cmd := fmt.Sprintf("$ %s %s\n", c.command, c.params)
-	c.writeOutputToFile([]byte(cmd))
-	if ok, out = c.runCommand(); ok {
-		c.status = true
+func (c *shellCommand) Execute(default_timeout time.Duration, env map[string]string, params map[string]string, cancel <-chan struct{}) {
+	timeout := c.timeout
+	if timeout == 0 {
+		timeout = default_timeout
+	}
+	result := commandResult{state: State_running, exit_code: -1, started: time.Now()}
+	result.invocation, _ = c.invocation(redactParameters(params))
+	c.setResult(result)
+	// a command whose output can't be kept fails
+	if err := c.openLog(); err != nil {
+		log.Printf("error: %s: can't open its log: %v", c.name, err)
+		result.state = State_failed
 	} else {
-		c.status = false
+		result.state, result.exit_code = c.run(result.invocation, timeout, env, params, cancel)
+		err := c.log.Close()
+		if err == nil {
+			err = c.logError()
+		}
+		if err != nil && result.state == State_succeeded {
+			log.Printf("error: %s: can't write its log: %v", c.name, err)
+			result.state = State_failed
+		}
 	}
-	c.writeOutputToFile(out)
+	result.finished = time.Now()
+	c.setResult(result)
 }
 
-func (c *shellCommand) runCommand() (bool, []byte) {
-	ok := true
-	cmd := exec.Command(c.command, c.params)
-	cmd.Dir = c.stdio
-	out, err := cmd.CombinedOutput()
+// runs the command with its line, as shown, written first to its logs
+func (c *shellCommand) run(shown commandInvocation, timeout time.Duration, env map[string]string, params map[string]string, cancel <-chan struct{}) (int, int) {
+	c.writeLine("", "$ "+shown.line())
+	invocation, err := c.invocation(params)
 	if err != nil {
-		ok = false
+		c.writeLine("err", err.Error())
+		return State_failed, -1
+	}
+	state, exit_code := c.runCommand(invocation, timeout, c.environment(env, params), cancel)
+	switch state {
+	case State_timed_out:
+		c.writeLine("", fmt.Sprintf("*** timed out after %v ***", timeout))
+	case State_cancelled:
+		c.writeLine("", "*** cancelled ***")
+	}
+	return state, exit_code
+}
+
+func (c *shellCommand) Result() commandResult {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.result
+}
+
+func (c *shellCommand) setResult(result commandResult) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.result = result
+}
+
+// forgets the results of the previous run
+func (c *shellCommand) resetResult() {
+	c.setResult(commandResult{state: State_queued, exit_code: -1})
+}
+
+// returns the state the command ends in and its exit code
+func (c *shellCommand) runCommand(invocation commandInvocation, timeout time.Duration, env map[string]string, cancel <-chan struct{}) (int, int) {
+	var cmd *exec.Cmd
+	if c.shell {
+		cmd = exec.Command("/bin/sh", "-c", invocation.line())
+	} else {
+		cmd = exec.Command(invocation.command, invocation.args...)
+	}
+	cmd.Dir = invocation.dir
+	cmd.Env = environ(env)
+	stdout := newLineWriter(c, "out")
+	stderr := newLineWriter(c, "err")
+	defer stdout.Flush()
+	defer stderr.Flush()
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// own process group, so a timeout reaches every child of the command
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		c.writeLine("err", err.Error())
+		return State_failed, -1
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			return State_failed, cmd.ProcessState.ExitCode()
+		}
+		return State_succeeded, cmd.ProcessState.ExitCode()
+	case <-expired:
+		log.Printf("%s timed out after %v", c.name, timeout)
+		killProcessGroup(cmd.Process.Pid, done)
+		return State_timed_out, cmd.ProcessState.ExitCode()
+	case <-cancel:
+		log.Printf("%s cancelled", c.name)
+		killProcessGroup(cmd.Process.Pid, done)
+		return State_cancelled, cmd.ProcessState.ExitCode()
 	}
-	return ok, out
+}
+
+// merges the command's own variables over the stage environment, and the
+// parameters of the build over both
+func (c *shellCommand) environment(stage_env map[string]string, params map[string]string) map[string]string {
+	return mergeEnvironments(stage_env, c.env, params, map[string]string{
+		"PCI_COMMAND_NAME": c.name})
+}
+
+func (c *shellCommand) invocation(params map[string]string) (commandInvocation, error) {
+	words := params
+	if c.shell {
+		words = quoteParameters(params)
+	}
+	args := make([]string, len(c.params))
+	for i, arg := range c.params {
+		args[i] = substituteParameters(arg, words)
+	}
+	// commands run in the build directory unless they name their own
+	dir := c.stdio
+	if c.dir != "" {
+		dir = substituteParameters(c.dir, params)
+	}
+	invocation := commandInvocation{command: substituteParameters(c.command, words),
+		args:  args,
+		dir:   dir,
+		shell: c.shell}
+	return invocation, checkDirectoryParameters(c.dir, params)
+}
+
+func killProcessGroup(pid int, done chan error) {
+	syscall.Kill(-pid, syscall.SIGTERM)
+	select {
+	case <-done:
+		return
+	case <-time.After(kill_grace_period):
+	}
+	syscall.Kill(-pid, syscall.SIGKILL)
+	<-done
 }
 
 func exists(path string) (bool, error) {
@@ -93,29 +270,44 @@ func exists(path string) (bool, error) {
 	return false, err
 }
 
-func (c *shellCommand) writeOutputToFile(out []byte) {
-	var buffer bytes.Buffer
-	if ok, _ := exists(c.stdio); !ok {
-		log.Printf("error: %s doesn't exist", c.stdio)
-		os.Exit(-1)
-	}
-	buffer.WriteString(c.stdio)
-	buffer.WriteString("/stdio.txt")
-	fo, err := os.OpenFile(
-		buffer.String(),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
-		0660)
-	if err != nil {
-		panic(err)
-	}
-	defer func() {
-		if err := fo.Close(); err != nil {
-			panic(err)
+// the command logs to its own file and to the logs of its stage and build
+func (c *shellCommand) attachLogs(stage *Stage, build *Build) {
+	path := filepath.Join(build.log_dir, logs_directory, stage.name, c.name+".txt")
+	c.log = newLogStream(path)
+	c.logs = []*logStream{c.log, stage.log, build.log}
+}
+
+func (c *shellCommand) openLog() error {
+	c.mutex.Lock()
+	c.tail = nil
+	c.log_err = nil
+	c.mutex.Unlock()
+	return c.log.Open(true)
+}
+
+func (c *shellCommand) logError() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.log_err
+}
+
+// writes one line of output to every log and keeps it in the tail
+func (c *shellCommand) writeLine(tag string, line string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	formatted := formatLine(tag, line)
+	for _, l := range c.logs {
+		if err := l.WriteString(formatted); err != nil && c.log_err == nil {
+			c.log_err = err
 		}
-	}()
-	if _, err := fo.Write(out); err != nil {
-		panic(err)
 	}
+	c.tail = appendTail(c.tail, line)
+}
+
+func (c *shellCommand) Tail() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string{}, c.tail...)
 }
 
 type shellCommands []*shellCommand
@@ -129,9 +321,9 @@ func (commands *shellCommands) Add(sc *shellCommand) {
 	*commands = append(*commands, sc)
 }
 
-func (commands *shellCommands) Execute() {
+func (commands *shellCommands) Execute(default_timeout time.Duration, env map[string]string, params map[string]string, cancel <-chan struct{}) {
 	for _, c := range *commands {
-		c.Execute()
+		c.Execute(default_timeout, env, params, cancel)
 	}
 }
 
@@ -26,41 +26,115 @@
 
 package builder
 
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+)
+
 type Stage struct {
-	name     string
-	priority int
-	state    int
-	commands shellCommands
-	status   bool
+	name       string
+	priority   int
+	state      int
+	timeout    time.Duration
+	env        map[string]string
+	depends_on []string
+	commands   shellCommands
+	cancel     chan struct{}
+	cancelled  bool
+	started    time.Time
+	finished   time.Time
+	build      *Build
+	log        *logStream
 }
 
 func NewStage(name string,
 	priority int,
-	state int) *Stage {
+	state int,
+	timeout time.Duration,
+	env map[string]string,
+	depends_on []string) *Stage {
 	return &Stage{
-		name:     name,
-		priority: priority,
-		state:    state,
-		status:   false}
+		name:       name,
+		priority:   priority,
+		state:      state,
+		timeout:    timeout,
+		env:        env,
+		depends_on: depends_on}
 }
 
 func (s *Stage) AddCommand(command *shellCommand) {
 	s.commands.Add(command)
+	if s.build != nil {
+		command.attachLogs(s, s.build)
+	}
 }
 
 func (s *Stage) AddCommands(commands shellCommands) {
 	s.commands = commands
+	if s.build != nil {
+		s.attachLogs(s.build)
+	}
+}
+
+func (s *Stage) attachLogs(build *Build) {
+	s.build = build
+	s.log = newLogStream(filepath.Join(build.log_dir, logs_directory, s.name+".txt"))
+	for _, c := range s.commands {
+		c.attachLogs(s, build)
+	}
 }
 
-func (s *Stage) Execute() {
-	s.status = true
+// runs the commands until one of them doesn't succeed or cancel is closed,
+// returns the state the stage ends in
+func (s *Stage) Execute(default_timeout time.Duration, env map[string]string, params map[string]string, cancel <-chan struct{}) int {
+	if s.timeout != 0 {
+		default_timeout = s.timeout
+	}
+	if err := s.log.Open(true); err != nil {
+		log.Printf("error: stage %s: can't open its log: %v", s.name, err)
+		return State_failed
+	}
+	defer s.log.Close()
+	for _, c := range s.commands {
+		c.resetResult()
+	}
 	it := s.commands.GetCommands()
 	for it.Next() {
+		select {
+		case <-cancel:
+			return State_cancelled
+		default:
+		}
 		command := it.Value()
-		command.Execute()
-		if !command.status {
-			s.status = command.status
-			break
+		command.Execute(default_timeout, env, params, cancel)
+		if state := command.Result().state; state != State_succeeded {
+			return state
 		}
 	}
+	return State_succeeded
+}
+
+// must be called with the builder mutex held
+func (s *Stage) setState(state int) error {
+	if err := transition(&s.state, state); err != nil {
+		return fmt.Errorf("stage %s: %v", s.name, err)
+	}
+	return nil
+}
+
+// Cancel stops a running stage or drops a queued one, must be called with the
+// builder mutex held
+func (s *Stage) Cancel() bool {
+	switch {
+	case s.state == State_queued:
+		logTransition(s.setState(State_cancelled))
+	case s.state == State_running && !s.cancelled:
+		s.cancelled = true
+		close(s.cancel)
+	default:
+		return false
+	}
+	return true
 }
@@ -26,37 +26,115 @@
 
 package builder
 
+import (
+	"fmt"
+	"log"
+)
+
 const (
 	State_undefined = iota
-	State_ready
-	State_building
-	State_finished
+	State_queued
+	State_running
+	State_succeeded
+	State_failed
+	State_cancelled
+	State_skipped
+	State_timed_out
 )
 
+var state_names = map[int]string{
+	State_undefined: "undefined",
+	State_queued:    "queued",
+	State_running:   "running",
+	State_succeeded: "succeeded",
+	State_failed:    "failed",
+	State_cancelled: "cancelled",
+	State_skipped:   "skipped",
+	State_timed_out: "timed_out",
+}
+
+// names used before the state machine, still accepted in configurations
+var legacy_states = map[string]int{
+	"state_undefined": State_undefined,
+	"state_ready":     State_queued,
+	"state_building":  State_running,
+	"state_finished":  State_succeeded,
+}
+
+// every allowed transition, finished states can only be queued again
+var transitions = map[int][]int{
+	State_undefined: {State_queued},
+	State_queued:    {State_running, State_cancelled, State_skipped},
+	State_running:   {State_succeeded, State_failed, State_cancelled, State_timed_out},
+	State_succeeded: {State_queued},
+	State_failed:    {State_queued},
+	State_cancelled: {State_queued},
+	State_skipped:   {State_queued},
+	State_timed_out: {State_queued},
+}
+
 func str2state(str string) (state int) {
-	switch {
-	case str == "state_ready":
-		state = State_ready
-	case str == "state_building":
-		state = State_building
-	case str == "state_finished":
-		state = State_finished
-	default:
-		state = State_undefined
+	if state, ok := legacy_states[str]; ok {
+		return state
+	}
+	for state, name := range state_names {
+		if name == str {
+			return state
+		}
 	}
-	return state
+	return State_undefined
+}
+
+// whether a configuration may name a state so, leaving it empty included
+func isStateName(str string) bool {
+	if _, ok := legacy_states[str]; ok || str == "" {
+		return true
+	}
+	for _, name := range state_names {
+		if name == str {
+			return true
+		}
+	}
+	return false
 }
 
 func state2str(state int) (str string) {
-	switch {
-	case state == State_ready:
-		str = "state_ready"
-	case state == State_building:
-		str = "state_building"
-	case state == State_finished:
-		str = "state_finished"
-	default:
-		str = "state_undefined"
-	}
-	return str
+	if str, ok := state_names[state]; ok {
+		return str
+	}
+	return state_names[State_undefined]
+}
+
+func isLegacyState(str string) bool {
+	_, ok := legacy_states[str]
+	return ok
+}
+
+func isFinished(state int) bool {
+	return state != State_undefined && state != State_queued && state != State_running
+}
+
+func canTransition(from int, to int) bool {
+	for _, state := range transitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// reports transitions the scheduler should never attempt
+func logTransition(err error) {
+	if err != nil {
+		log.Printf("error: %v", err)
+	}
+}
+
+// transition is the only way states change once loaded
+func transition(state *int, to int) error {
+	if !canTransition(*state, to) {
+		return fmt.Errorf("can't go from %s to %s", state2str(*state), state2str(to))
+	}
+	*state = to
+	return nil
 }
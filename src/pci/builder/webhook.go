@@ -0,0 +1,188 @@
+/*-
+ * Copyright (c) 2013 Javier M. Mellid
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE NETBSD FOUNDATION, INC. AND CONTRIBUTORS
+ * ``AS IS'' AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+ * TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED.  IN NO EVENT SHALL THE FOUNDATION OR CONTRIBUTORS
+ * BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package builder
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// WebhookBody lets a build be queued by push events
+type WebhookBody struct {
+	// verifies the signature of every payload
+	Secret string
+	// only pushes to this branch queue the build, the branch of the
+	// build's Source when unset
+	Branch string `json:",omitempty"`
+}
+
+// largest payload accepted
+const max_hook_payload = 5 << 20
+
+// the commit a forge sends when a branch is deleted
+const zero_commit = "0000000000000000000000000000000000000000"
+
+var valid_commit = regexp.MustCompile("^[0-9a-f]{7,64}$")
+
+// a push event, as sent by GitHub, GitLab, Gitea or anything else
+type hookEvent struct {
+	sender string
+	ref    string
+	commit string
+	// why the payload doesn't queue the build
+	ignored string
+}
+
+// the fields of every supported payload, the generic one sends Ref and
+// Commit only
+type hookPayload struct {
+	Ref         string `json:"ref"`
+	After       string `json:"after"`
+	CheckoutSha string `json:"checkout_sha"`
+	Commit      string `json:"commit"`
+}
+
+// checks that the payload was sent by someone knowing the secret. GitHub,
+// Gitea and generic senders sign the body with HMAC-SHA256, GitLab sends
+// the secret itself as its token.
+func verifyHook(header http.Header, body []byte, secret string) *httpError {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+	signatures := []string{
+		header.Get("X-Hub-Signature-256"),
+		header.Get("X-PCI-Signature"),
+		header.Get("X-Gitea-Signature"),
+		header.Get("X-Gogs-Signature")}
+	for _, signature := range signatures {
+		if signature == "" {
+			continue
+		}
+		signature = strings.TrimPrefix(signature, "sha256=")
+		given, err := hex.DecodeString(signature)
+		if err == nil && hmac.Equal(given, expected) {
+			return nil
+		}
+		return newHttpError(http.StatusUnauthorized, "invalid signature")
+	}
+	if token := header.Get("X-Gitlab-Token"); token != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1 {
+			return nil
+		}
+		return newHttpError(http.StatusUnauthorized, "invalid token")
+	}
+	return newHttpError(http.StatusUnauthorized, "payload is not signed")
+}
+
+// reads the ref and commit of a push event. Events other than pushes are
+// ignored rather than refused, so forges can send pings.
+func parseHook(header http.Header, content_type string, body []byte) (*hookEvent, *httpError) {
+	sender := "webhook"
+	for _, forge := range []string{"GitHub", "Gitea", "Gogs", "Gitlab"} {
+		switch event := header.Get("X-" + forge + "-Event"); event {
+		case "":
+		case "push", "Push Hook":
+			sender = strings.ToLower(forge)
+		default:
+			return &hookEvent{ignored: fmt.Sprintf("%s event", event)}, nil
+		}
+	}
+	// GitHub may send the payload as a form
+	if strings.HasPrefix(content_type, "application/x-www-form-urlencoded") {
+		if form, err := url.ParseQuery(string(body)); err == nil && form.Get("payload") != "" {
+			body = []byte(form.Get("payload"))
+		}
+	}
+	var payload hookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, newHttpError(http.StatusBadRequest, "invalid payload: %v", err)
+	}
+	event := &hookEvent{sender: sender, ref: payload.Ref, commit: payload.Commit}
+	switch {
+	case payload.CheckoutSha != "":
+		event.commit = payload.CheckoutSha
+	case payload.After != "":
+		event.commit = payload.After
+	}
+	if event.commit == zero_commit {
+		event.ignored = fmt.Sprintf("%s was deleted", event.ref)
+		return event, nil
+	}
+	// a generic payload may name a plain branch
+	if event.ref != "" && !strings.HasPrefix(event.ref, "refs/") {
+		event.ref = "refs/heads/" + event.ref
+	}
+	if event.ref == "" || !validRef(strings.TrimPrefix(event.ref, "refs/")) {
+		return nil, newHttpError(http.StatusBadRequest, "invalid ref '%s'", payload.Ref)
+	}
+	event.commit = strings.ToLower(event.commit)
+	if event.commit != "" && !valid_commit.MatchString(event.commit) {
+		return nil, newHttpError(http.StatusBadRequest, "invalid commit '%s'", event.commit)
+	}
+	return event, nil
+}
+
+func validRef(ref string) bool {
+	return valid_branch.MatchString(ref) && !strings.HasPrefix(ref, "-") &&
+		!strings.Contains(ref, "/-") && !strings.Contains(ref, "..")
+}
+
+// the ref whose pushes queue the build, empty for any
+func (build *Build) hookRef() string {
+	switch {
+	case build.webhook.Branch != "":
+		return "refs/heads/" + build.webhook.Branch
+	case build.source != nil && build.source.Branch != "":
+		return build.source.ref()
+	}
+	return ""
+}
+
+// requests a run of a build for a verified push event, with the ref and
+// commit pushed. Returns the request and whether it was coalesced with a
+// queued one, or nil and false when the event is ignored.
+func (b *Builder) QueueFromHook(build *Build, event *hookEvent) (*buildRequest, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if want := build.hookRef(); want != "" && event.ref != want {
+		event.ignored = fmt.Sprintf("%s is not %s", event.ref, want)
+		return nil, false
+	}
+	reason := "push of " + strings.TrimSpace(event.ref+" "+shortCommit(event.commit))
+	request := newBuildRequest(build, reason, event.sender)
+	request.Ref = event.ref
+	request.Commit = event.commit
+	return b.enqueue(build, request)
+}
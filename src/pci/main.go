@@ -28,39 +28,88 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"log"
+	"os"
 	_b "pci/builder"
 )
 
 func main() {
 	update_json := flag.Bool("update-json", false, "update json conf file")
-	conf_json := flag.String("conf-json", "", "json conf file")
+	conf_json := flag.String("conf-json", "", "conf file (.json, .yaml, .yml or .toml)")
+	data_dir := flag.String("data-dir", "", "directory for the run history")
+	in_place := flag.Bool("in-place", false, "with -update-json, save the conf file in place")
+	backups := flag.Int("backups", 3, "backups kept when saving in place")
+	listen := flag.String("listen", "", "address the API listens on (default :8080)")
+	socket := flag.String("socket", "", "unix socket the API listens on")
+	tls_cert := flag.String("tls-cert", "", "certificate serving the API over TLS")
+	tls_key := flag.String("tls-key", "", "key of the TLS certificate")
+	client_ca := flag.String("client-ca", "", "CA signing the certificates TLS clients must present")
+	validate := flag.Bool("validate", false, "check the conf file and exit")
+	new_token := flag.Bool("new-token", false, "print a new API token and its hash, and exit")
 	flag.Parse()
+	if *new_token {
+		token, hash, err := _b.NewToken()
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		fmt.Printf("token: %s\nhash:  %s\n", token, hash)
+		return
+	}
+	if *validate {
+		if !_b.ValidateJSON(*conf_json) {
+			os.Exit(1)
+		}
+		return
+	}
 	builder := _b.NewBuilderFromJSON(*conf_json)
 	builder.UpdateOnDisk(update_json)
+	builder.SaveInPlace(in_place, backups)
+	builder.SetDataDirectory(data_dir)
+	builder.SetListen(listen, socket, tls_cert, tls_key, client_ca)
 	runNextStage := builder.RunStage()
-	httpd_c := _b.HttpServer(builder)
-	build_c := make(chan bool)
-	go func() { build_c <- true }()
+	httpd_c, err := _b.HttpServer(builder)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	config_c := builder.WatchConfig()
+	go builder.PollSources()
+	go builder.RunSchedules()
+	// a single dispatcher runs the scheduler steps until it is idle again
+	build_c := make(chan bool, 1)
+	go func() {
+		for range build_c {
+			if builder.IsIdle() {
+				builder.SetIdle(false)
+				runNextStage = builder.Reload()
+			}
+			for runNextStage() {
+			}
+		}
+	}()
+	build_c <- true
 	for {
 		select {
-		case next_one := <-build_c:
-			go func() {
-				if next_one {
-					if builder.IsIdle() {
-						builder.SetIdle(false)
-						runNextStage = builder.Reload()
-					}
-					build_c <- runNextStage()
-				}
-			}()
+		case <-builder.Triggers():
+			dispatch(builder, build_c)
+		case <-config_c:
+			dispatch(builder, build_c)
 		case httpd_action := <-httpd_c:
-			go func() {
-				if httpd_action == _b.Httpd_run_build {
-					if builder.IsIdle() {
-						build_c <- true
-					}
-				}
-			}()
+			if httpd_action == _b.Httpd_run_build {
+				dispatch(builder, build_c)
+			}
 		}
 	}
 }
+
+// wakes the dispatcher when idle, or its scheduler when busy
+func dispatch(builder *_b.Builder, build_c chan bool) {
+	if !builder.IsIdle() {
+		builder.Wake()
+		return
+	}
+	select {
+	case build_c <- true:
+	default:
+	}
+}